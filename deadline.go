@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/common/log"
+)
+
+// deadlineCollector collects the metrics of an Exporter for a single request,
+// skipping the remaining tubes once the deadline is reached.
+type deadlineCollector struct {
+	*Exporter
+	deadline time.Time
+}
+
+// Collect implements the prometheus.Collector interface.
+func (c deadlineCollector) Collect(ch chan<- prometheus.Metric) {
+	c.collect(ch, c.deadline)
+}
+
+// scrapeDeadline returns the deadline of the scrape from the timeout sent by
+// Prometheus minus the configured offset, or the zero time when no timeout is
+// sent or it isn't positive. The offset isn't subtracted when it would leave no
+// time to scrape.
+func scrapeDeadline(r *http.Request) time.Time {
+	header := r.Header.Get("X-Prometheus-Scrape-Timeout-Seconds")
+	if header == "" {
+		return time.Time{}
+	}
+	seconds, err := strconv.ParseFloat(header, 64)
+	if err != nil {
+		log.Warnf("unable to parse scrape timeout %q: %s", header, err)
+		return time.Time{}
+	}
+	if seconds <= 0 {
+		return time.Time{}
+	}
+	timeout := time.Duration(seconds * float64(time.Second))
+	if timeout > *scrapeTimeoutOffset {
+		timeout -= *scrapeTimeoutOffset
+	}
+	return time.Now().Add(timeout)
+}
+
+// metricsHandler serves the metrics of the registry along with the ones of the
+// exporter, scraped within the timeout sent by Prometheus.
+func metricsHandler(exporter *Exporter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		scrapeRegistry := prometheus.NewRegistry()
+		scrapeRegistry.MustRegister(deadlineCollector{exporter, scrapeDeadline(r)})
+
+		promhttp.HandlerFor(
+			prometheus.Gatherers{registry, scrapeRegistry},
+			promhttp.HandlerOpts{ErrorHandling: promhttp.ContinueOnError},
+		).ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"net"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestScrapeDeadline(t *testing.T) {
+	r := httptest.NewRequest("GET", "/metrics", nil)
+	if deadline := scrapeDeadline(r); !deadline.IsZero() {
+		t.Fatalf("Expected no deadline without timeout header, got %s", deadline)
+	}
+
+	r.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", "10.5")
+	expected := time.Now().Add(10500*time.Millisecond - *scrapeTimeoutOffset)
+	deadline := scrapeDeadline(r)
+	if deadline.Before(expected) || deadline.After(expected.Add(time.Second)) {
+		t.Fatalf("Expected deadline around %s, got %s", expected, deadline)
+	}
+
+	r.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", "0")
+	if deadline := scrapeDeadline(r); !deadline.IsZero() {
+		t.Fatalf("Expected no deadline with a zero timeout, got %s", deadline)
+	}
+
+	// The offset isn't subtracted from shorter timeouts.
+	r.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", "0.2")
+	expected = time.Now().Add(200 * time.Millisecond)
+	deadline = scrapeDeadline(r)
+	if deadline.Before(expected) || deadline.After(expected.Add(time.Second)) {
+		t.Fatalf("Expected deadline around %s, got %s", expected, deadline)
+	}
+}
+
+func TestExporterDeadline(t *testing.T) {
+	mapper = newTubeMapper()
+
+	server := newFakeBeanstalkd(t,
+		map[string]string{"current-jobs-ready": "3"},
+		map[string]map[string]string{
+			"a": {"current-jobs-ready": "1"},
+			"b": {"current-jobs-ready": "2"},
+			"c": {"current-jobs-ready": "3"},
+		},
+	)
+	defer server.close()
+	server.setTubeDelay(300 * time.Millisecond)
+
+	e := NewExporter(server.addr())
+	defer e.Close()
+
+	// A deadline reached while fetching the tubes keeps the server stats and
+	// the tubes fetched so far: a is fetched, b times out and c is skipped.
+	collector := deadlineCollector{e, time.Now().Add(500 * time.Millisecond)}
+	families := gather(t, collector)
+	if findMetric(families["beanstalkd_current_jobs_ready"], map[string]string{"instance": server.addr()}) == nil {
+		t.Fatalf("missing current_jobs_ready for %s", server.addr())
+	}
+	if findMetric(families["beanstalkd_tube_current_jobs_ready"], map[string]string{"tube": "a"}) == nil {
+		t.Fatalf("missing tube_current_jobs_ready for a")
+	}
+	for _, tube := range []string{"b", "c"} {
+		if findMetric(families["beanstalkd_tube_current_jobs_ready"], map[string]string{"tube": tube}) != nil {
+			t.Fatalf("unexpected tube_current_jobs_ready for %s past the deadline", tube)
+		}
+	}
+	m := findMetric(families["beanstalkd_exporter_tubes_skipped_total"], map[string]string{"instance": server.addr()})
+	if m == nil || m.GetCounter().GetValue() != 1 {
+		t.Fatalf("Expected 1 skipped tube, got %v", m)
+	}
+
+	// A reached deadline doesn't start the scrape, the server is reported
+	// down along with its last successful scrape.
+	families = gather(t, deadlineCollector{e, time.Now().Add(-time.Second)})
+	m = findMetric(families["beanstalkd_up"], map[string]string{"instance": server.addr()})
+	if m == nil || m.GetGauge().GetValue() != 0 {
+		t.Fatalf("Expected %s down past the deadline, got %v", server.addr(), m)
+	}
+	m = findMetric(families["beanstalkd_last_scrape_success_timestamp_seconds"], map[string]string{"instance": server.addr()})
+	if m == nil || m.GetGauge().GetValue() == 0 {
+		t.Fatalf("Expected the last successful scrape of %s, got %v", server.addr(), m)
+	}
+}
+
+func TestExporterDeadlineConcurrentScrapes(t *testing.T) {
+	mapper = newTubeMapper()
+
+	server := newFakeBeanstalkd(t,
+		map[string]string{"current-jobs-ready": "3"},
+		map[string]map[string]string{
+			"a": {"current-jobs-ready": "1"},
+			"b": {"current-jobs-ready": "2"},
+		},
+	)
+	defer server.close()
+	server.setTubeDelay(450 * time.Millisecond)
+
+	e := NewExporter(server.addr())
+	defer e.Close()
+
+	// Concurrent scrapes share the same scrape of the server instead of
+	// waiting for each other past their deadline.
+	deadline := time.Now().Add(time.Second)
+	results := make(chan map[string]*dto.MetricFamily, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			results <- gather(t, deadlineCollector{e, deadline})
+		}()
+	}
+	for i := 0; i < 2; i++ {
+		families := <-results
+		m := findMetric(families["beanstalkd_up"], map[string]string{"instance": server.addr()})
+		if m == nil || m.GetGauge().GetValue() != 1 {
+			t.Fatalf("%d. Expected %s up, got %v", i, server.addr(), m)
+		}
+		if findMetric(families["beanstalkd_current_jobs_ready"], map[string]string{"instance": server.addr()}) == nil {
+			t.Fatalf("%d. missing current_jobs_ready for %s", i, server.addr())
+		}
+	}
+}
+
+func TestExporterDeadlineSilentServer(t *testing.T) {
+	mapper = newTubeMapper()
+
+	server := newFakeBeanstalkd(t,
+		map[string]string{"current-jobs-ready": "3"},
+		map[string]map[string]string{"default": {"current-jobs-ready": "1"}},
+	)
+	defer server.close()
+
+	silent := newSilentListener(t)
+	defer silent.Close()
+
+	e := NewExporter(server.addr(), silent.Addr().String())
+	defer e.Close()
+
+	// Every scrape returns by the deadline with the stats of the healthy
+	// server, and the silent one down.
+	for i := 0; i < 2; i++ {
+		start := time.Now()
+		families := gather(t, deadlineCollector{e, start.Add(500 * time.Millisecond)})
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Fatalf("%d. Expected the scrape to stop at the deadline, took %s", i, elapsed)
+		}
+
+		if findMetric(families["beanstalkd_tube_current_jobs_ready"], map[string]string{"instance": server.addr()}) == nil {
+			t.Fatalf("%d. missing tube_current_jobs_ready for %s", i, server.addr())
+		}
+		m := findMetric(families["beanstalkd_up"], map[string]string{"instance": server.addr()})
+		if m == nil || m.GetGauge().GetValue() != 1 {
+			t.Fatalf("%d. Expected %s up, got %v", i, server.addr(), m)
+		}
+		m = findMetric(families["beanstalkd_up"], map[string]string{"instance": silent.Addr().String()})
+		if m == nil || m.GetGauge().GetValue() != 0 {
+			t.Fatalf("%d. Expected %s down, got %v", i, silent.Addr(), m)
+		}
+	}
+}
+
+// newSilentListener returns a listener accepting connections but never
+// answering.
+func newSilentListener(t *testing.T) net.Listener {
+	silent, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %s", err)
+	}
+	go func() {
+		var conns []net.Conn
+		defer func() {
+			for _, conn := range conns {
+				conn.Close()
+			}
+		}()
+		for {
+			conn, err := silent.Accept()
+			if err != nil {
+				return
+			}
+			conns = append(conns, conn)
+		}
+	}()
+	return silent
+}
+
+func TestExporterDeadlineJoinedScrape(t *testing.T) {
+	mapper = newTubeMapper()
+
+	server := newFakeBeanstalkd(t,
+		map[string]string{"current-jobs-ready": "3"},
+		map[string]map[string]string{"default": {"current-jobs-ready": "1"}},
+	)
+	defer server.close()
+	silent := newSilentListener(t)
+	defer silent.Close()
+
+	e := NewExporter(server.addr(), silent.Addr().String())
+	defer e.Close()
+
+	// A scrape with a later deadline is held by the silent server.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		gather(t, deadlineCollector{e, time.Now().Add(2 * time.Second)})
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	// A scrape joining it gives up at its own deadline, and still reports
+	// the health of every server.
+	start := time.Now()
+	families := gather(t, deadlineCollector{e, start.Add(300 * time.Millisecond)})
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Expected the scrape to stop at the deadline, took %s", elapsed)
+	}
+	for _, addr := range []string{server.addr(), silent.Addr().String()} {
+		m := findMetric(families["beanstalkd_up"], map[string]string{"instance": addr})
+		if m == nil || m.GetGauge().GetValue() != 0 {
+			t.Fatalf("Expected %s down, got %v", addr, m)
+		}
+	}
+	<-done
+
+	// The next scrape isn't held by the earlier one.
+	families = gather(t, deadlineCollector{e, time.Now().Add(500 * time.Millisecond)})
+	m := findMetric(families["beanstalkd_up"], map[string]string{"instance": server.addr()})
+	if m == nil || m.GetGauge().GetValue() != 1 {
+		t.Fatalf("Expected %s up, got %v", server.addr(), m)
+	}
+}
@@ -1,11 +1,14 @@
 package main
 
 import (
-	"io"
+	"crypto/tls"
+	"math"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/kr/beanstalk"
@@ -15,16 +18,73 @@ import (
 
 const (
 	dialTimeout = 30 * time.Second
+
+	// staticSource is the discovery source of the servers given to NewExporter.
+	staticSource = "static"
+
+	// deadlineGrace is how long servers are waited for past the scrape
+	// deadline, for their connections to time out and return what they
+	// collected so far.
+	deadlineGrace = 100 * time.Millisecond
+
+	// overflowTube is the tube of the series summing the tubes past the
+	// limit of tube series, see SetMaxTubeSeries.
+	overflowTube = "__overflow__"
 )
 
+// target is a beanstalkd server found by a discovery source, along with the
+// labels to attach to all its metrics.
+type target struct {
+	address string
+	labels  prometheus.Labels
+}
+
+// server holds the connection state of a single beanstalkd instance.
+type server struct {
+	address string
+	labels  prometheus.Labels
+	conn    *lazyConn
+	// connections of the tube stats workers
+	workerConns []*lazyConn
+	// time of the last successful scrape
+	lastSuccess time.Time
+	// holds a token while the server is being scraped, which may last past
+	// the scrape that stopped waiting for it
+	busy chan struct{}
+	// id of the beanstalkd process seen by the last scrape, and the number
+	// of times it changed
+	lastID   string
+	restarts float64
+	// start time of the beanstalkd process with the last id
+	startTime float64
+}
+
 type Exporter struct {
 	// use to protect against concurrent collection
 	mutex sync.RWMutex
 
-	conn    io.ReadWriteCloser
-	address string
+	servers []*server
+	// scrape in progress, shared by the concurrent collections
+	inflightMutex sync.Mutex
+	inflight      *sharedScrape
+	// health of the servers reported when the scrape in progress can't be
+	// waited for, see updateDownHealth
+	downHealthMutex sync.Mutex
+	downHealth      []prometheus.Metric
+	// targets found by every discovery source
+	sources map[string][]target
+	// names of the labels set by any target
+	targetLabelNames []string
 
-	connectionTimeout time.Duration
+	connectionTimeout  time.Duration
+	tlsConfig          *tls.Config
+	tlsEnabled         bool
+	numTubeStatWorkers int
+	useCounters        bool
+	namespace          string
+	legacyNames        bool
+	tubeFilter         *tubeFilter
+	maxTubeSeries      int
 
 	nameReplacer  *regexp.Regexp
 	labelReplacer *regexp.Regexp
@@ -36,14 +96,29 @@ type Exporter struct {
 	scrapeConnectionErrorMetric prometheus.Counter
 	scrapeHistogramMetric       prometheus.Histogram
 
-	// use to collects all the errors asynchronously
-	cherrs chan error
+	discoveredTargetsMetric *prometheus.GaugeVec
+	workerBusyMetric        *prometheus.CounterVec
+	workerTubesMetric       *prometheus.CounterVec
+	skippedTubesMetric      *prometheus.CounterVec
+	filteredTubesMetric     *prometheus.CounterVec
+
+	// latest metrics of the background polling, see StartPolling
+	polling           bool
+	snapshotMutex     sync.RWMutex
+	snapshot          []prometheus.Metric
+	snapshotTime      time.Time
+	snapshotAgeMetric prometheus.Gauge
+
+	descs *descCache
 }
 
-func NewExporter(address string) *Exporter {
-	cherrs := make(chan error)
+func NewExporter(addresses ...string) *Exporter {
 	exporter := &Exporter{
-		address: address,
+		sources:            map[string][]target{},
+		numTubeStatWorkers: 1,
+		namespace:          "beanstalkd",
+		legacyNames:        false,
+		descs:              newDescCache(),
 		scrapeCountMetric: prometheus.NewCounterVec(
 			prometheus.CounterOpts{
 				Namespace: "beanstalkd",
@@ -69,18 +144,151 @@ func NewExporter(address string) *Exporter {
 				Help:      "Scrape time buckets.",
 			},
 		),
+		discoveredTargetsMetric: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: "beanstalkd",
+				Subsystem: "exporter",
+				Name:      "discovered_targets",
+				Help:      "The number of beanstalkd servers found by each discovery source.",
+			},
+			[]string{"source"},
+		),
+		workerBusyMetric: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "beanstalkd",
+				Subsystem: "exporter",
+				Name:      "tube_stat_worker_busy_seconds_total",
+				Help:      "The time each tube stats worker spent fetching tube stats.",
+			},
+			[]string{"instance", "worker"},
+		),
+		workerTubesMetric: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "beanstalkd",
+				Subsystem: "exporter",
+				Name:      "tube_stat_worker_tubes_total",
+				Help:      "The number of tubes each tube stats worker fetched stats for.",
+			},
+			[]string{"instance", "worker"},
+		),
+		skippedTubesMetric: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "beanstalkd",
+				Subsystem: "exporter",
+				Name:      "tubes_skipped_total",
+				Help:      "The number of tubes whose stats weren't fetched because the scrape deadline was reached.",
+			},
+			[]string{"instance"},
+		),
+		filteredTubesMetric: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "beanstalkd",
+				Subsystem: "exporter",
+				Name:      "tubes_filtered_total",
+				Help:      "The number of tubes whose stats weren't fetched because of the tube filter or a drop mapping.",
+			},
+			[]string{"instance"},
+		),
+		snapshotAgeMetric: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace: "beanstalkd",
+				Subsystem: "exporter",
+				Name:      "snapshot_age_seconds",
+				Help:      "The age of the metrics served from the background polling.",
+			},
+		),
+	}
+	targets := make([]target, len(addresses))
+	for i, address := range addresses {
+		targets[i] = target{address: address}
+	}
+	exporter.setTargets(staticSource, targets)
 
-		cherrs: cherrs,
+	return exporter
+}
+
+// SetTargets replaces the servers found by the given discovery source.
+// Connections to the servers no longer found by any source are closed, new
+// servers are connected to on their first scrape.
+func (e *Exporter) SetTargets(source string, targets []target) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	e.setTargets(source, targets)
+}
+
+func (e *Exporter) setTargets(source string, targets []target) {
+	e.sources[source] = targets
+	e.discoveredTargetsMetric.WithLabelValues(source).Set(float64(len(targets)))
+
+	sourceNames := make([]string, 0, len(e.sources))
+	for name := range e.sources {
+		sourceNames = append(sourceNames, name)
+	}
+	sort.Strings(sourceNames)
+
+	existing := map[string]*server{}
+	for _, s := range e.servers {
+		s.wait()
+		existing[s.address] = s
 	}
 
-	go func(e *Exporter) {
-		for {
-			log.Errorln(<-cherrs)
-			e.scrapeCountMetric.WithLabelValues("failure").Inc()
+	var servers []*server
+	seen := map[string]bool{}
+	labelNames := map[string]bool{}
+	for _, name := range sourceNames {
+		for _, t := range e.sources[name] {
+			if seen[t.address] {
+				continue
+			}
+			seen[t.address] = true
+
+			s, ok := existing[t.address]
+			if !ok {
+				log.Infof("Adding beanstalkd server %s", t.address)
+				s = &server{address: t.address, busy: make(chan struct{}, 1)}
+			}
+			delete(existing, t.address)
+			s.labels = t.labels
+			servers = append(servers, s)
+
+			for label := range t.labels {
+				labelNames[label] = true
+			}
 		}
-	}(exporter)
+	}
 
-	return exporter
+	for _, s := range existing {
+		log.Infof("Removing beanstalkd server %s", s.address)
+		for i := range s.workerConns {
+			worker := strconv.Itoa(i)
+			e.workerBusyMetric.DeleteLabelValues(s.address, worker)
+			e.workerTubesMetric.DeleteLabelValues(s.address, worker)
+		}
+		e.skippedTubesMetric.DeleteLabelValues(s.address)
+		e.filteredTubesMetric.DeleteLabelValues(s.address)
+		s.close()
+	}
+	e.servers = servers
+
+	e.targetLabelNames = make([]string, 0, len(labelNames))
+	for label := range labelNames {
+		e.targetLabelNames = append(e.targetLabelNames, label)
+	}
+	sort.Strings(e.targetLabelNames)
+	e.updateDownHealth()
+}
+
+// serverLabels returns the labels attached to every metric of the server. All
+// the target label names are set, so that metrics of servers from different
+// targets have consistent label names.
+func (e *Exporter) serverLabels(s *server) prometheus.Labels {
+	labels := prometheus.Labels{}
+	for _, label := range e.targetLabelNames {
+		labels[label] = s.labels[label]
+	}
+	labels["instance"] = s.address
+	return labels
 }
 
 // SetConnectionTimeout sets the connection timeout value
@@ -88,113 +296,555 @@ func (e *Exporter) SetConnectionTimeout(timeout time.Duration) {
 	e.connectionTimeout = timeout
 }
 
-// Describe implements the prometheus.Collector interface, emits on the chan
-// the descriptors of all the possible metrics.
-// Since it's impossible to know in advance the metrics that going to be
-// collected Describe is equivalent of a Collect call.
-func (e *Exporter) Describe(ch chan<- *prometheus.Desc) {
+// SetTLSConfig sets the TLS configuration used to connect to tls:// addresses,
+// or to all the servers when enabled is set.
+func (e *Exporter) SetTLSConfig(config *tls.Config, enabled bool) {
+	e.tlsConfig = config
+	e.tlsEnabled = enabled
+}
+
+// SetNumTubeStatWorkers sets the number of workers, each with its own
+// connection, fetching the tube stats of every server.
+func (e *Exporter) SetNumTubeStatWorkers(n int) {
+	if n < 1 {
+		n = 1
+	}
+	e.numTubeStatWorkers = n
+}
+
+// SetUseCounters enables exporting the cumulative stats as counters with a
+// _total suffix, instead of gauges named after the stats.
+func (e *Exporter) SetUseCounters(enabled bool) {
+	e.useCounters = enabled
+}
+
+// SetNamespace sets the prefix of the names of the server and tube metrics.
+func (e *Exporter) SetNamespace(namespace string) {
+	e.namespace = namespace
+}
+
+// SetLegacyNames enables exporting the server and tube metrics under their
+// legacy names, without namespace and as gauges, alongside the new ones.
+func (e *Exporter) SetLegacyNames(enabled bool) {
+	e.legacyNames = enabled
+}
+
+// SetTubeFilter sets the filter selecting the tubes whose stats are fetched.
+func (e *Exporter) SetTubeFilter(filter *tubeFilter) {
+	e.tubeFilter = filter
+}
+
+// SetMaxTubeSeries sets the maximum number of tube series of a server, after
+// mapping and aggregation. The stats of the tubes of the following series are
+// summed into a single overflow tube. 0 means no limit.
+func (e *Exporter) SetMaxTubeSeries(n int) {
+	e.maxTubeSeries = n
+}
+
+// Close closes the connections to all the servers.
+func (e *Exporter) Close() {
 	e.mutex.Lock()
 	defer e.mutex.Unlock()
 
-	e.scrapeCountMetric.Describe(ch)
-	e.scrapeConnectionErrorMetric.Describe(ch)
-	e.scrapeHistogramMetric.Describe(ch)
-	mapper.configLoadsMetric.Describe(ch)
-	mapper.mappingsCountMetric.Describe(ch)
+	for _, s := range e.servers {
+		s.close()
+	}
+}
 
-	// TODO: move this init to the NewExporter
-	// if we release a new major version.
-	if e.conn == nil {
-		conn, err := newLazyConn(e.address, dialTimeout, e.connectionTimeout)
-		if err != nil {
-			e.scrapeConnectionErrorMetric.Inc()
-			log.Warnf("unable to connect to beanstalkd: %s", err)
-			return
-		}
-		e.conn = conn
+// wait waits for the end of the scrape of the server, if an earlier scrape
+// stopped waiting for it.
+func (s *server) wait() {
+	s.busy <- struct{}{}
+	<-s.busy
+}
+
+// acquire waits for the end of the scrape of the server, if an earlier scrape
+// stopped waiting for it, and takes its token. It gives up when the deadline
+// isn't zero and is reached first.
+func (s *server) acquire(deadline time.Time) bool {
+	if deadline.IsZero() {
+		s.busy <- struct{}{}
+		return true
 	}
+	if !time.Now().Before(deadline) {
+		return false
+	}
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case s.busy <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
 
-	client := beanstalk.NewConn(e.conn)
-	collectors := e.scrape(client)
-	for _, collector := range collectors {
-		collector.Describe(ch)
+func (s *server) close() {
+	s.wait()
+	for _, conn := range append([]*lazyConn{s.conn}, s.workerConns...) {
+		if conn == nil {
+			continue
+		}
+		if err := conn.Close(); err != nil {
+			log.Warnf("unable to close connection to beanstalkd %s: %s", s.address, err)
+		}
 	}
+	s.conn = nil
+	s.workerConns = nil
 }
 
-// Collect implements the prometheus.Collector interface, emits on the chan all
-// the metrics.
-func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
+// StartPolling scrapes all the servers in the background every interval.
+// Collect then serves the metrics of the latest poll instead of scraping the
+// servers. It must be called before the exporter is registered.
+func (e *Exporter) StartPolling(interval time.Duration) {
+	e.polling = true
+	go func() {
+		e.poll(interval)
+		for range time.Tick(interval) {
+			e.poll(interval)
+		}
+	}()
+}
+
+// poll scrapes all the servers within the timeout and records their metrics as
+// the latest snapshot.
+func (e *Exporter) poll(timeout time.Duration) {
 	e.mutex.Lock()
-	defer e.mutex.Unlock()
+	metrics := e.scrapeServers(time.Now().Add(timeout))
+	e.mutex.Unlock()
 
+	e.snapshotMutex.Lock()
+	defer e.snapshotMutex.Unlock()
+	e.snapshot = metrics
+	e.snapshotTime = time.Now()
+}
+
+// describeSelf emits the descriptors of the exporter's own metrics, the only
+// ones known in advance.
+func (e *Exporter) describeSelf(ch chan<- *prometheus.Desc) {
+	e.scrapeCountMetric.Describe(ch)
+	e.scrapeConnectionErrorMetric.Describe(ch)
+	e.scrapeHistogramMetric.Describe(ch)
+	e.discoveredTargetsMetric.Describe(ch)
+	e.workerBusyMetric.Describe(ch)
+	e.workerTubesMetric.Describe(ch)
+	e.skippedTubesMetric.Describe(ch)
+	e.filteredTubesMetric.Describe(ch)
+	mapper.configLoadsMetric.Describe(ch)
+	mapper.mappingsCountMetric.Describe(ch)
+	mapper.lastReloadMetric.Describe(ch)
+	mapper.lastReloadSuccessMetric.Describe(ch)
+	mapper.configHashMetric.Describe(ch)
+	if e.polling {
+		e.snapshotAgeMetric.Describe(ch)
+	}
+}
+
+// collectSelf emits the exporter's own metrics.
+func (e *Exporter) collectSelf(ch chan<- prometheus.Metric) {
 	e.scrapeCountMetric.Collect(ch)
 	e.scrapeConnectionErrorMetric.Collect(ch)
 	e.scrapeHistogramMetric.Collect(ch)
+	e.discoveredTargetsMetric.Collect(ch)
+	e.workerBusyMetric.Collect(ch)
+	e.workerTubesMetric.Collect(ch)
+	e.skippedTubesMetric.Collect(ch)
+	e.filteredTubesMetric.Collect(ch)
 	mapper.configLoadsMetric.Collect(ch)
 	mapper.mappingsCountMetric.Collect(ch)
+	mapper.lastReloadMetric.Collect(ch)
+	mapper.lastReloadSuccessMetric.Collect(ch)
+	mapper.configHashMetric.Collect(ch)
+}
 
+// Describe implements the prometheus.Collector interface, emits on the chan
+// the descriptors of the exporter's own metrics.
+// Since it's impossible to know in advance the beanstalkd stats that are going
+// to be collected, they are emitted by Collect as const metrics with
+// descriptors that aren't described here.
+func (e *Exporter) Describe(ch chan<- *prometheus.Desc) {
+	e.describeSelf(ch)
+}
+
+// Collect implements the prometheus.Collector interface, emits on the chan all
+// the metrics.
+func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
+	e.collect(ch, time.Time{})
+}
+
+// collect emits all the metrics. When the deadline is reached, the remaining
+// tubes are skipped and the metrics collected so far are emitted. A zero
+// deadline is bounded by the dial timeout.
+func (e *Exporter) collect(ch chan<- prometheus.Metric, deadline time.Time) {
+	if e.polling {
+		e.collectSelf(ch)
+		e.collectSnapshot(ch)
+		return
+	}
+
+	metrics := e.sharedScrape(deadline)
+	// after the scrape, so that the exporter's own metrics account for it
+	e.collectSelf(ch)
+	for _, metric := range metrics {
+		ch <- metric
+	}
+}
+
+// sharedScrape is a scrape of the servers whose metrics are emitted by all the
+// collections started while it's in progress.
+type sharedScrape struct {
+	done    chan struct{}
+	metrics []prometheus.Metric
+}
+
+// sharedScrape joins the scrape in progress, or starts one with the deadline,
+// and returns its metrics. A zero deadline is replaced by the dial timeout, so
+// that a server that never answers can't hold the scrape forever. The scrape is
+// waited for until shortly after the deadline, and every server is reported
+// down if it hasn't ended.
+func (e *Exporter) sharedScrape(deadline time.Time) []prometheus.Metric {
+	if deadline.IsZero() {
+		deadline = time.Now().Add(dialTimeout)
+	}
+
+	e.inflightMutex.Lock()
+	scrape := e.inflight
+	if scrape == nil {
+		scrape = &sharedScrape{done: make(chan struct{})}
+		e.inflight = scrape
+		go func() {
+			e.mutex.Lock()
+			scrape.metrics = e.scrapeServers(deadline)
+			e.mutex.Unlock()
+
+			e.inflightMutex.Lock()
+			e.inflight = nil
+			e.inflightMutex.Unlock()
+			close(scrape.done)
+		}()
+	}
+	e.inflightMutex.Unlock()
+
+	wait := time.Until(deadline)
+	if wait < 0 {
+		wait = 0
+	}
+	timer := time.NewTimer(wait + 2*deadlineGrace)
+	defer timer.Stop()
+	select {
+	case <-scrape.done:
+		return scrape.metrics
+	case <-timer.C:
+		log.Warnf("the scrape of the beanstalkd servers didn't end before the scrape deadline")
+		e.downHealthMutex.Lock()
+		defer e.downHealthMutex.Unlock()
+		return e.downHealth
+	}
+}
+
+// updateDownHealth records the health metrics reporting every server down,
+// emitted by the collections that can't wait for the scrape in progress. It
+// must be called with the mutex held whenever the servers or their last
+// successful scrape change.
+func (e *Exporter) updateDownHealth() {
+	var metrics []prometheus.Metric
+	for _, s := range e.servers {
+		metrics = append(metrics, e.healthMetrics(s, false, 0)...)
+	}
+
+	e.downHealthMutex.Lock()
+	defer e.downHealthMutex.Unlock()
+	e.downHealth = metrics
+}
+
+// collectSnapshot emits the metrics of the latest poll, if any.
+func (e *Exporter) collectSnapshot(ch chan<- prometheus.Metric) {
+	e.snapshotMutex.RLock()
+	defer e.snapshotMutex.RUnlock()
+
+	if e.snapshotTime.IsZero() {
+		return
+	}
+	e.snapshotAgeMetric.Set(time.Since(e.snapshotTime).Seconds())
+	e.snapshotAgeMetric.Collect(ch)
+
+	for _, metric := range e.snapshot {
+		ch <- metric
+	}
+}
+
+// scrapeServers scrapes all the configured servers concurrently. A server that
+// can't be reached doesn't contribute any metric but doesn't prevent the others
+// from being scraped. Servers still being scraped shortly after the deadline
+// are reported down without waiting for them, like the servers whose scrape
+// couldn't start before the deadline because an earlier scrape that stopped
+// waiting for them is still in progress.
+func (e *Exporter) scrapeServers(deadline time.Time) []prometheus.Metric {
+	start := time.Now()
+	results := make(chan serverScrape, len(e.servers))
+	scrapes := make([]*serverScrape, len(e.servers))
+	// scrapeWaiting, scrapeStarted or scrapeAbandoned for every server
+	states := make([]int32, len(e.servers))
+	for i, s := range e.servers {
+		go func(i int, s *server) {
+			if !s.acquire(deadline) {
+				results <- serverScrape{i: i, skipped: true}
+				return
+			}
+			defer func() { <-s.busy }()
+			if !atomic.CompareAndSwapInt32(&states[i], scrapeWaiting, scrapeStarted) {
+				// scrapeServers stopped waiting for the server
+				results <- serverScrape{i: i, skipped: true}
+				return
+			}
+			results <- e.scrapeServer(i, s, deadline)
+		}(i, s)
+	}
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		wait := time.Until(deadline)
+		if wait < 0 {
+			wait = 0
+		}
+		timer := time.NewTimer(wait + deadlineGrace)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+wait:
+	for pending := len(e.servers); pending > 0; pending-- {
+		select {
+		case r := <-results:
+			scrapes[r.i] = &r
+		case <-timeout:
+			break wait
+		}
+	}
+
+	var metrics []prometheus.Metric
+	for i, s := range e.servers {
+		r := scrapes[i]
+		if r == nil {
+			if atomic.CompareAndSwapInt32(&states[i], scrapeWaiting, scrapeAbandoned) {
+				r = &serverScrape{i: i, skipped: true}
+			} else {
+				log.Warnf("beanstalkd %s didn't answer before the scrape deadline", s.address)
+				r = &serverScrape{i: i, duration: time.Since(start)}
+			}
+		}
+		if r.skipped {
+			// an earlier scrape that stopped waiting for the server may
+			// still be in progress
+			log.Warnf("the scrape of beanstalkd %s didn't start before the scrape deadline", s.address)
+		}
+		if r.up {
+			s.lastSuccess = time.Now()
+		}
+		metrics = append(metrics, r.metrics...)
+		metrics = append(metrics, e.healthMetrics(s, r.up, r.duration)...)
+	}
+	e.updateDownHealth()
+	return metrics
+}
+
+// States of the scrape of a server, see scrapeServers.
+const (
+	scrapeWaiting int32 = iota
+	scrapeStarted
+	scrapeAbandoned
+)
+
+// serverScrape is the outcome of the scrape of the i-th server.
+type serverScrape struct {
+	i        int
+	metrics  []prometheus.Metric
+	up       bool
+	duration time.Duration
+	// the scrape didn't start before the deadline
+	skipped bool
+}
+
+// scrapeServer connects to the server if needed and scrapes it.
+func (e *Exporter) scrapeServer(i int, s *server, deadline time.Time) serverScrape {
+	start := time.Now()
+	metrics, up := e.connectAndScrape(s, deadline)
+	return serverScrape{i: i, metrics: metrics, up: up, duration: time.Since(start)}
+}
+
+// healthMetrics returns the health of the server, always reported, even when
+// it can't be reached.
+func (e *Exporter) healthMetrics(s *server, up bool, duration time.Duration) []prometheus.Metric {
+	upValue := 0.0
+	if up {
+		upValue = 1
+	}
+	var lastSuccess float64
+	if !s.lastSuccess.IsZero() {
+		lastSuccess = float64(s.lastSuccess.UnixNano()) / 1e9
+	}
+
+	return []prometheus.Metric{
+		e.healthGauge(s, "up", "Whether the last scrape of the server was successful.", upValue),
+		e.healthGauge(s, "last_scrape_duration_seconds", "The duration of the last scrape of the server.", duration.Seconds()),
+		e.healthGauge(s, "last_scrape_success_timestamp_seconds", "The time of the last successful scrape of the server, in seconds since the epoch.", lastSuccess),
+	}
+}
+
+// connectAndScrape connects to the server if needed and scrapes it. The server
+// is up when its stats could be fetched.
+func (e *Exporter) connectAndScrape(s *server, deadline time.Time) (metrics []prometheus.Metric, up bool) {
 	// TODO: move this init to the NewExporter
 	// if we release a new major version.
-	if e.conn == nil {
-		conn, err := newLazyConn(e.address, dialTimeout, e.connectionTimeout)
+	if s.conn == nil {
+		conn, err := newLazyConn(s.address, dialTimeout, e.connectionTimeout, deadline, e.tlsConfig, e.tlsEnabled)
 		if err != nil {
 			e.scrapeConnectionErrorMetric.Inc()
-			log.Warnf("unable to connect to beanstalkd: %s", err)
-			return
+			log.Warnf("unable to connect to beanstalkd %s: %s", s.address, err)
+			return nil, false
+		}
+		s.conn = conn
+	}
+	s.conn.SetDeadline(deadline)
+
+	return e.scrape(s, beanstalk.NewConn(s.conn), deadline)
+}
+
+// serverGauge returns a gauge of the server, named with the namespace.
+func (e *Exporter) serverGauge(s *server, name, help string, value float64) prometheus.Metric {
+	return e.constServerGauge(s, prometheus.BuildFQName(e.namespace, "", name), help, value)
+}
+
+// healthGauge returns a gauge about the health of the server. Unlike the
+// stats, it's always named with the beanstalkd prefix, so that an empty
+// namespace doesn't export an up series clashing with the one of Prometheus.
+func (e *Exporter) healthGauge(s *server, name, help string, value float64) prometheus.Metric {
+	return e.constServerGauge(s, prometheus.BuildFQName("beanstalkd", "", name), help, value)
+}
+
+func (e *Exporter) constServerGauge(s *server, fqName, help string, value float64) prometheus.Metric {
+	labelNames, labelValues := sortedLabels(e.serverLabels(s))
+	desc := e.descs.get(fqName, help, labelNames)
+	return prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, value, labelValues...)
+}
+
+// infoStats are the string stats of a server exported as labels of the info
+// metric.
+var infoStats = []string{"version", "hostname", "id", "os", "platform"}
+
+func isInfoStat(key string) bool {
+	for _, info := range infoStats {
+		if key == info {
+			return true
 		}
-		e.conn = conn
 	}
+	return false
+}
 
-	client := beanstalk.NewConn(e.conn)
-	collectors := e.scrape(client)
-	for _, collector := range collectors {
-		collector.Collect(ch)
+// infoMetric returns a gauge of the server, always 1, carrying its string
+// stats as labels.
+func (e *Exporter) infoMetric(s *server, stats map[string]string) prometheus.Metric {
+	labels := e.serverLabels(s)
+	for _, key := range infoStats {
+		// beanstalkd quotes the version
+		labels[key] = strings.Trim(stats[key], `"`)
 	}
+	labelNames, labelValues := sortedLabels(labels)
+	desc := e.descs.get(prometheus.BuildFQName(e.namespace, "", "info"), "Information about the server, from its string stats.", labelNames)
+	return prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, 1, labelValues...)
+}
+
+// restartMetrics returns the number of restarts of the server and its start
+// time. beanstalkd generates a new id on every start, so a restart is detected
+// when the id differs from the one of the last scrape.
+func (e *Exporter) restartMetrics(s *server, stats map[string]string) []prometheus.Metric {
+	id := stats["id"]
+	if id != "" {
+		if s.lastID != "" && s.lastID != id {
+			log.Infof("beanstalkd %s restarted", s.address)
+			s.restarts++
+		}
+		if s.lastID != id {
+			s.startTime = 0
+		}
+		s.lastID = id
+	}
+
+	labelNames, labelValues := sortedLabels(e.serverLabels(s))
+	desc := e.descs.get(prometheus.BuildFQName(e.namespace, "", "restarts_total"), "The number of restarts of the server detected by the exporter.", labelNames)
+	metrics := []prometheus.Metric{prometheus.MustNewConstMetric(desc, prometheus.CounterValue, s.restarts, labelValues...)}
+
+	// the start time is computed once per process, since the uptime is in
+	// whole seconds and would make it vary between scrapes
+	startTime := s.startTime
+	if uptime, err := strconv.ParseFloat(stats["uptime"], 64); err == nil && startTime == 0 {
+		startTime = math.Floor(float64(time.Now().UnixNano())/1e9) - uptime
+		if id != "" {
+			s.startTime = startTime
+		}
+	}
+	if startTime != 0 {
+		metrics = append(metrics, e.serverGauge(s, "start_time_seconds", "The start time of the server, in seconds since the epoch.", startTime))
+	}
+	return metrics
 }
 
 // scrape retrieves all the available metrics and invoke the given callback on each of them.
-func (e *Exporter) scrape(conn *beanstalk.Conn) []prometheus.Collector {
-	var collectors []prometheus.Collector
+func (e *Exporter) scrape(s *server, conn *beanstalk.Conn, deadline time.Time) (metrics []prometheus.Metric, up bool) {
 	start := time.Now()
 	defer func() {
 		e.scrapeHistogramMetric.Observe(time.Since(start).Seconds())
 	}()
 
 	if *logLevel == "debug" {
-		log.Debugf("Debug: Calling %s stats()", e.address)
+		log.Debugf("Debug: Calling %s stats()", s.address)
 	}
 
 	stats, err := conn.Stats()
 	if err != nil {
 		log.Errorf("Error requesting Stats(): %v", err)
 		e.scrapeCountMetric.WithLabelValues("failure").Inc()
-		return collectors
+		return metrics, false
 	}
 	e.scrapeCountMetric.WithLabelValues("success").Inc()
+
+	labelNames, labelValues := sortedLabels(e.serverLabels(s))
+
+	if expiry := s.conn.PeerCertificateExpiry(); !expiry.IsZero() {
+		metrics = append(metrics, e.serverGauge(s,
+			"tls_peer_certificate_expiry_seconds",
+			"The expiry time of the TLS certificate of the server, in seconds since the epoch.",
+			float64(expiry.Unix()),
+		))
+	}
+
+	metrics = append(metrics, e.infoMetric(s, stats))
+	metrics = append(metrics, e.restartMetrics(s, stats)...)
+
 	for key, value := range stats {
-		// ignore these stats
-		if key == "hostname" || key == "id" || key == "pid" {
+		// ignore these stats, the string ones are exported by the info
+		// metric even when they look like numbers, e.g. version 1.10
+		if key == "pid" || isInfoStat(key) {
+			continue
+		}
+
+		iValue, err := strconv.ParseFloat(value, 64)
+		if err != nil {
 			continue
 		}
 
-		name := strings.Replace(key, "-", "_", -1)
 		help := systemStatsHelp[key]
 		if help == "" {
 			help = key
 		}
-		gauge := prometheus.NewGauge(prometheus.GaugeOpts{
-			Name:        name,
-			Help:        help,
-			ConstLabels: prometheus.Labels{"instance": e.address},
-		})
 
-		iValue, _ := strconv.ParseFloat(value, 64)
-		gauge.Set(iValue)
-		collectors = append(collectors, gauge)
+		for _, m := range e.statMetrics(systemStatsTypes, key, strings.Replace(key, "-", "_", -1)) {
+			desc := e.descs.get(m.name, help, labelNames)
+			metrics = append(metrics, prometheus.MustNewConstMetric(desc, m.valueType, iValue, labelValues...))
+		}
 	}
 
 	if *logLevel == "debug" {
-		log.Debugf("Debug: Calling %s ListTubes()", e.address)
+		log.Debugf("Debug: Calling %s ListTubes()", s.address)
 	}
 
 	// stat every tube
@@ -202,101 +852,376 @@ func (e *Exporter) scrape(conn *beanstalk.Conn) []prometheus.Collector {
 	if err != nil {
 		log.Errorf("Error requesting ListTubes(): %v", err)
 		e.scrapeCountMetric.WithLabelValues("failure").Inc()
-		return collectors
+		return metrics, true
 	}
 	e.scrapeCountMetric.WithLabelValues("success").Inc()
 
-	var outs []<-chan []prometheus.Collector
-	for i, tube := range tubes {
-		out := e.scrapeWorker(i, conn, tube)
-		outs = append(outs, out)
+	// the same mapping config is used for the whole scrape, even if it's
+	// reloaded meanwhile
+	mappings := mapper.current()
+
+	// filter the tubes before fetching any of their stats
+	kept := tubes[:0]
+	for _, tube := range tubes {
+		if e.tubeFilter.keep(tube) && !mappings.dropped(tube) {
+			kept = append(kept, tube)
+		}
 	}
-	for _, out := range outs {
-		tubeCollectors := <-out
-		collectors = append(collectors, tubeCollectors...)
+	e.filteredTubesMetric.WithLabelValues(s.address).Add(float64(len(tubes) - len(kept)))
+	tubes = kept
+
+	// with aggregation, tubes having the same labels are exported as one
+	// series
+	aggregate := mapper.aggregating()
+	tubeLabels := make(map[string]prometheus.Labels, len(tubes))
+	tubeKeys := make(map[string]string, len(tubes))
+	for _, tube := range tubes {
+		labels := e.tubeLabels(s, mappings, tube)
+		tubeLabels[tube] = labels
+		if aggregate {
+			_, labelValues := sortedLabels(labels)
+			tubeKeys[tube] = strings.Join(labelValues, "\xff")
+		} else {
+			tubeKeys[tube] = tube
+		}
+	}
+
+	// tubes of the series past the limit are summed into a single series
+	overflow := map[string]bool{}
+	if e.maxTubeSeries > 0 {
+		series := map[string]bool{}
+		for _, tube := range tubes {
+			key := tubeKeys[tube]
+			if !series[key] && len(series) >= e.maxTubeSeries {
+				overflow[tube] = true
+				continue
+			}
+			series[key] = true
+		}
 	}
-	return collectors
-}
 
-func (e *Exporter) scrapeWorker(i int, c *beanstalk.Conn, name string) <-chan []prometheus.Collector {
-	out := make(chan []prometheus.Collector)
+	queue := make(chan string)
+	out := make(chan tubeStats)
+	var wg sync.WaitGroup
+	workers := 0
+	for i, workerConn := range e.workerConns(s, deadline) {
+		if workerConn == nil {
+			continue
+		}
+		workers++
+		wg.Add(1)
+		go func(i int, c *beanstalk.Conn) {
+			defer wg.Done()
+			e.scrapeWorker(i, s, c, queue, out, deadline)
+		}(i, beanstalk.NewConn(workerConn))
+	}
+	if workers == 0 {
+		log.Errorf("No tube stats worker connected to %s", s.address)
+		return metrics, true
+	}
 
 	go func() {
-		defer close(out)
-		if *logLevel == "debug" {
-			log.Debugf("Debug: scrape worker %d started", i)
+		defer close(queue)
+		for _, tube := range tubes {
+			queue <- tube
 		}
+	}()
+	go func() {
+		wg.Wait()
+		close(out)
+	}()
 
-		if *logLevel == "debug" {
-			log.Debugf("Debug: scrape worker %d fetching tube %s", i, name)
+	var groups []*tubeGroup
+	groupsByKey := map[string]*tubeGroup{}
+
+	overflowStats := map[string]float64{}
+	for t := range out {
+		if overflow[t.name] {
+			aggregateTubeStats(overflowStats, t.stats)
+			continue
+		}
+
+		labels := tubeLabels[t.name]
+		if !aggregate {
+			metrics = append(metrics, e.tubeMetrics(labels, t.stats)...)
+			continue
 		}
 
-		out <- e.statTube(c, name)
+		key := tubeKeys[t.name]
+		group, ok := groupsByKey[key]
+		if !ok {
+			group = &tubeGroup{labels: labels, stats: map[string]float64{}}
+			groupsByKey[key] = group
+			groups = append(groups, group)
+		}
+		aggregateTubeStats(group.stats, t.stats)
+		group.count++
+	}
 
-		if *logLevel == "debug" {
-			log.Debugf("Debug: scrape worker %d finished", i)
+	for _, group := range groups {
+		metrics = append(metrics, e.tubeMetrics(group.labels, group.stats)...)
+		metrics = append(metrics, e.tubeCountMetric(group.labels, group.count))
+	}
+
+	if e.maxTubeSeries > 0 {
+		if len(overflow) > 0 {
+			labels := e.overflowLabels(s, mappings)
+			metrics = append(metrics, e.tubeMetrics(labels, overflowStats)...)
+			if aggregate {
+				metrics = append(metrics, e.tubeCountMetric(labels, len(overflow)))
+			}
 		}
-	}()
-	return out
+		metrics = append(metrics, e.serverGauge(s,
+			"overflow_tubes",
+			"The number of tubes summed into the "+overflowTube+" tube during the last scrape.",
+			float64(len(overflow)),
+		))
+	}
+	return metrics, true
+}
+
+// workerConns returns the connections of the tube stats workers of the server,
+// connecting the missing ones, all bounded by the deadline. Workers that can't
+// connect are nil.
+func (e *Exporter) workerConns(s *server, deadline time.Time) []*lazyConn {
+	for len(s.workerConns) < e.numTubeStatWorkers {
+		s.workerConns = append(s.workerConns, nil)
+	}
+	for i, conn := range s.workerConns {
+		if conn != nil {
+			conn.SetDeadline(deadline)
+			continue
+		}
+		conn, err := newLazyConn(s.address, dialTimeout, e.connectionTimeout, deadline, e.tlsConfig, e.tlsEnabled)
+		if err != nil {
+			e.scrapeConnectionErrorMetric.Inc()
+			log.Warnf("unable to connect worker %d to beanstalkd %s: %s", i, s.address, err)
+			continue
+		}
+		s.workerConns[i] = conn
+	}
+	return s.workerConns
 }
 
-func (e *Exporter) statTube(c *beanstalk.Conn, tubeName string) []prometheus.Collector {
-	var collectors []prometheus.Collector
+// tubeStats are the numeric stats of a tube.
+type tubeStats struct {
+	name  string
+	stats map[string]float64
+}
 
+// scrapeWorker fetches the stats of the tubes taken from the queue until it's
+// closed. Once the deadline is reached the remaining tubes are skipped.
+func (e *Exporter) scrapeWorker(i int, s *server, c *beanstalk.Conn, queue <-chan string, out chan<- tubeStats, deadline time.Time) {
 	if *logLevel == "debug" {
-		log.Debugf("Debug: Calling %s Tube{name: %s}.Stats()", e.address, tubeName)
+		log.Debugf("Debug: scrape worker %d started", i)
 	}
 
-	var labels prometheus.Labels
-	mappedLabels, mappingPresent := mapper.getMapping(tubeName)
-	if mappingPresent {
-		labels = mappedLabels
-		labels["tube"] = labels["name"]
-		delete(labels, "name")
-	} else {
-		labels = prometheus.Labels{"tube": tubeName}
-	}
+	worker := strconv.Itoa(i)
+	busyMetric := e.workerBusyMetric.WithLabelValues(s.address, worker)
+	tubesMetric := e.workerTubesMetric.WithLabelValues(s.address, worker)
+	skippedMetric := e.skippedTubesMetric.WithLabelValues(s.address)
+	for name := range queue {
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			skippedMetric.Inc()
+			continue
+		}
 
-	labels["instance"] = e.address
+		if *logLevel == "debug" {
+			log.Debugf("Debug: scrape worker %d fetching tube %s", i, name)
+		}
 
-	// be sure all labels are set
-	allLabelNames := append(mapper.getAllLabels(), "instance", "tube")
-	for _, l := range allLabelNames {
-		if labels[l] == "" {
-			labels[l] = ""
+		start := time.Now()
+		stats, err := e.statTube(s, c, name)
+		busyMetric.Add(time.Since(start).Seconds())
+		tubesMetric.Inc()
+
+		if err == nil {
+			out <- tubeStats{name, stats}
 		}
 	}
 
+	if *logLevel == "debug" {
+		log.Debugf("Debug: scrape worker %d finished", i)
+	}
+}
+
+// statTube fetches the numeric stats of a tube.
+func (e *Exporter) statTube(s *server, c *beanstalk.Conn, tubeName string) (map[string]float64, error) {
+	if *logLevel == "debug" {
+		log.Debugf("Debug: Calling %s Tube{name: %s}.Stats()", s.address, tubeName)
+	}
+
 	tube := beanstalk.Tube{Conn: c, Name: tubeName}
 	stats, err := tube.Stats()
 	if err != nil {
 		log.Errorf("Error tubes stats: %v", err)
 		e.scrapeCountMetric.WithLabelValues("failure").Inc()
-		return collectors
+		return nil, err
 	}
 	e.scrapeCountMetric.WithLabelValues("success").Inc()
 
+	values := map[string]float64{}
 	for key, value := range stats {
 		// ignore these stats
 		if key == "tube-name" || key == "name" {
 			continue
 		}
 
-		name := "tube_" + strings.Replace(key, "-", "_", -1)
+		iValue, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			continue
+		}
+		values[key] = iValue
+	}
+	return values, nil
+}
+
+// tubeGroup is the aggregation of the tubes mapped to the same labels.
+type tubeGroup struct {
+	labels prometheus.Labels
+	stats  map[string]float64
+	count  int
+}
+
+// aggregateTubeStats adds the stats of a tube to the aggregated ones: the
+// maximum is kept for the stats listed in tubeStatsMax, the other ones are
+// summed.
+func aggregateTubeStats(aggregated, stats map[string]float64) {
+	for key, value := range stats {
+		if !tubeStatsMax[key] {
+			aggregated[key] += value
+		} else if current, ok := aggregated[key]; !ok || value > current {
+			aggregated[key] = value
+		}
+	}
+}
+
+// tubeLabels returns the labels of the metrics of a tube.
+func (e *Exporter) tubeLabels(s *server, mappings *mappingSnapshot, tubeName string) prometheus.Labels {
+	// target labels come first so that mapped labels take precedence
+	labels := e.serverLabels(s)
+	mappedLabels, mappingPresent := mappings.getMapping(tubeName)
+	if mappingPresent {
+		for label, value := range mappedLabels {
+			labels[label] = value
+		}
+		labels["tube"] = labels["name"]
+		delete(labels, "name")
+	} else {
+		labels["tube"] = tubeName
+	}
+
+	labels["instance"] = s.address
+	e.completeTubeLabels(mappings, labels)
+	return labels
+}
+
+// overflowLabels returns the labels of the metrics of the tubes past the
+// limit of tube series.
+func (e *Exporter) overflowLabels(s *server, mappings *mappingSnapshot) prometheus.Labels {
+	labels := e.serverLabels(s)
+	labels["tube"] = overflowTube
+	e.completeTubeLabels(mappings, labels)
+	return labels
+}
+
+// completeTubeLabels sets all the mapped labels, so that the metrics of every
+// tube have the same label names.
+func (e *Exporter) completeTubeLabels(mappings *mappingSnapshot, labels prometheus.Labels) {
+	for _, l := range mappings.allLabels {
+		if labels[l] == "" {
+			labels[l] = ""
+		}
+	}
+}
+
+// tubeCountMetric returns the number of tubes aggregated into the series with
+// the labels.
+func (e *Exporter) tubeCountMetric(labels prometheus.Labels, count int) prometheus.Metric {
+	labelNames, labelValues := sortedLabels(labels)
+	desc := e.descs.get(prometheus.BuildFQName(e.namespace, "", "tube_count"), "The number of tubes aggregated into the series with these labels.", labelNames)
+	return prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, float64(count), labelValues...)
+}
+
+// tubeMetrics returns the metrics exporting the stats of a tube.
+func (e *Exporter) tubeMetrics(labels prometheus.Labels, stats map[string]float64) []prometheus.Metric {
+	var metrics []prometheus.Metric
+	labelNames, labelValues := sortedLabels(labels)
+	for key, value := range stats {
 		help := tubeStatsHelp[key]
 		if help == "" {
 			help = key
 		}
 
-		gaugeVec := prometheus.NewGaugeVec(prometheus.GaugeOpts{
-			Name: name,
-			Help: help,
-		}, allLabelNames)
+		for _, m := range e.statMetrics(tubeStatsTypes, key, "tube_"+strings.Replace(key, "-", "_", -1)) {
+			desc := e.descs.get(m.name, help, labelNames)
+			metrics = append(metrics, prometheus.MustNewConstMetric(desc, m.valueType, value, labelValues...))
+		}
+	}
+	return metrics
+}
+
+// statMetric is the name and the type of a metric exporting a stat.
+type statMetric struct {
+	name      string
+	valueType prometheus.ValueType
+}
+
+// statMetrics returns the metrics exporting a stat, given the types of the
+// stats and the legacy name of the metric: the namespaced one, and the legacy
+// one when enabled.
+func (e *Exporter) statMetrics(types map[string]prometheus.ValueType, key, legacyName string) []statMetric {
+	m := statMetric{prometheus.BuildFQName(e.namespace, "", legacyName), prometheus.GaugeValue}
+	if e.useCounters && types[key] == prometheus.CounterValue {
+		m = statMetric{m.name + "_total", prometheus.CounterValue}
+	}
+
+	metrics := []statMetric{m}
+	if e.legacyNames && m.name != legacyName {
+		metrics = append(metrics, statMetric{legacyName, prometheus.GaugeValue})
+	}
+	return metrics
+}
+
+// sortedLabels returns the names of the labels sorted, along with their values
+// in the same order.
+func sortedLabels(labels prometheus.Labels) (names []string, values []string) {
+	names = make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	values = make([]string, len(names))
+	for i, name := range names {
+		values[i] = labels[name]
+	}
+	return names, values
+}
+
+// descCache caches the descriptors of the beanstalkd stats, so that they
+// aren't allocated again for every server and tube on every scrape.
+type descCache struct {
+	mutex sync.Mutex
+	descs map[string]*prometheus.Desc
+}
+
+func newDescCache() *descCache {
+	return &descCache{descs: map[string]*prometheus.Desc{}}
+}
+
+// get returns the descriptor of the metric with the given name and variable
+// label names, creating it if needed.
+func (c *descCache) get(name, help string, labelNames []string) *prometheus.Desc {
+	key := name + "\xff" + strings.Join(labelNames, "\xff")
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 
-		gauge := gaugeVec.With(labels)
-		iValue, _ := strconv.ParseFloat(value, 64)
-		gauge.Set(iValue)
-		collectors = append(collectors, gauge)
+	desc, ok := c.descs[key]
+	if !ok {
+		desc = prometheus.NewDesc(name, help, labelNames, nil)
+		c.descs[key] = desc
 	}
-	return collectors
+	return desc
 }
@@ -0,0 +1,864 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// fakeBeanstalkd is a minimal beanstalkd server answering the stats commands
+// used by the exporter.
+type fakeBeanstalkd struct {
+	listener net.Listener
+	mutex    sync.Mutex
+	stats    map[string]string
+	tubes    map[string]map[string]string
+	// delay of the answers to stats-tube
+	tubeDelay time.Duration
+}
+
+func newFakeBeanstalkd(t *testing.T, stats map[string]string, tubes map[string]map[string]string) *fakeBeanstalkd {
+	return newFakeBeanstalkdOn(t, "tcp", "127.0.0.1:0", stats, tubes)
+}
+
+func newFakeBeanstalkdOn(t *testing.T, network, address string, stats map[string]string, tubes map[string]map[string]string) *fakeBeanstalkd {
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		t.Fatalf("unable to listen: %s", err)
+	}
+	return startFakeBeanstalkd(listener, stats, tubes)
+}
+
+func startFakeBeanstalkd(listener net.Listener, stats map[string]string, tubes map[string]map[string]string) *fakeBeanstalkd {
+	f := &fakeBeanstalkd{listener: listener, stats: stats, tubes: tubes}
+	go f.serve()
+	return f
+}
+
+func (f *fakeBeanstalkd) addr() string {
+	return f.listener.Addr().String()
+}
+
+// setTubeDelay delays the answers to stats-tube.
+func (f *fakeBeanstalkd) setTubeDelay(delay time.Duration) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.tubeDelay = delay
+}
+
+// setStats replaces the server stats.
+func (f *fakeBeanstalkd) setStats(stats map[string]string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.stats = stats
+}
+
+func (f *fakeBeanstalkd) close() {
+	f.listener.Close()
+}
+
+func (f *fakeBeanstalkd) serve() {
+	for {
+		conn, err := f.listener.Accept()
+		if err != nil {
+			return
+		}
+		go f.handle(conn)
+	}
+}
+
+func (f *fakeBeanstalkd) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case "stats":
+			f.mutex.Lock()
+			stats := f.stats
+			f.mutex.Unlock()
+			writeDict(conn, stats)
+		case "list-tubes":
+			var names []string
+			for name := range f.tubes {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			body := "---\n"
+			for _, name := range names {
+				body += "- " + name + "\n"
+			}
+			writeBody(conn, body)
+		case "stats-tube":
+			f.mutex.Lock()
+			delay := f.tubeDelay
+			f.mutex.Unlock()
+			time.Sleep(delay)
+			stats, ok := f.tubes[fields[1]]
+			if !ok {
+				fmt.Fprint(conn, "NOT_FOUND\r\n")
+				continue
+			}
+			writeDict(conn, stats)
+		default:
+			fmt.Fprint(conn, "UNKNOWN_COMMAND\r\n")
+		}
+	}
+}
+
+func writeDict(conn net.Conn, dict map[string]string) {
+	body := "---\n"
+	for k, v := range dict {
+		body += k + ": " + v + "\n"
+	}
+	writeBody(conn, body)
+}
+
+func writeBody(conn net.Conn, body string) {
+	fmt.Fprintf(conn, "OK %d\r\n%s\r\n", len(body), body)
+}
+
+// deadAddress returns an address nothing is listening on.
+func deadAddress(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %s", err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+	return addr
+}
+
+func gather(t *testing.T, c prometheus.Collector) map[string]*dto.MetricFamily {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(c)
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("unable to gather metrics: %s", err)
+	}
+	byName := map[string]*dto.MetricFamily{}
+	for _, family := range families {
+		byName[family.GetName()] = family
+	}
+	return byName
+}
+
+func labelValue(m *dto.Metric, name string) string {
+	for _, pair := range m.GetLabel() {
+		if pair.GetName() == name {
+			return pair.GetValue()
+		}
+	}
+	return ""
+}
+
+// findMetric returns the metric of the family having all the given labels.
+func findMetric(family *dto.MetricFamily, labels map[string]string) *dto.Metric {
+	if family == nil {
+		return nil
+	}
+	for _, m := range family.GetMetric() {
+		matches := true
+		for name, value := range labels {
+			if labelValue(m, name) != value {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			return m
+		}
+	}
+	return nil
+}
+
+func TestExporterMultipleServers(t *testing.T) {
+	mapper = newTubeMapper()
+
+	first := newFakeBeanstalkd(t,
+		map[string]string{"current-jobs-ready": "3"},
+		map[string]map[string]string{"default": {"current-jobs-ready": "3"}},
+	)
+	defer first.close()
+	second := newFakeBeanstalkd(t,
+		map[string]string{"current-jobs-ready": "5"},
+		map[string]map[string]string{"emails": {"current-jobs-ready": "5"}},
+	)
+	defer second.close()
+	dead := deadAddress(t)
+
+	e := NewExporter(first.addr(), dead, second.addr())
+	defer e.Close()
+	families := gather(t, e)
+
+	for addr, want := range map[string]float64{first.addr(): 3, second.addr(): 5} {
+		m := findMetric(families["beanstalkd_current_jobs_ready"], map[string]string{"instance": addr})
+		if m == nil {
+			t.Fatalf("missing current_jobs_ready for %s", addr)
+		}
+		if got := m.GetGauge().GetValue(); got != want {
+			t.Errorf("current_jobs_ready for %s: expected %v, got %v", addr, want, got)
+		}
+	}
+	if m := findMetric(families["beanstalkd_current_jobs_ready"], map[string]string{"instance": dead}); m != nil {
+		t.Errorf("unexpected current_jobs_ready for unreachable server %s", dead)
+	}
+	if m := findMetric(families["beanstalkd_tube_current_jobs_ready"], map[string]string{"instance": second.addr(), "tube": "emails"}); m == nil {
+		t.Errorf("missing tube_current_jobs_ready for %s", second.addr())
+	}
+	for addr, want := range map[string]float64{first.addr(): 1, dead: 0, second.addr(): 1} {
+		labels := map[string]string{"instance": addr}
+		m := findMetric(families["beanstalkd_up"], labels)
+		if m == nil {
+			t.Fatalf("missing beanstalkd_up for %s", addr)
+		}
+		if got := m.GetGauge().GetValue(); got != want {
+			t.Errorf("beanstalkd_up for %s: expected %v, got %v", addr, want, got)
+		}
+		m = findMetric(families["beanstalkd_last_scrape_success_timestamp_seconds"], labels)
+		if m == nil {
+			t.Fatalf("missing beanstalkd_last_scrape_success_timestamp_seconds for %s", addr)
+		}
+		if got := m.GetGauge().GetValue(); (got > 0) != (want == 1) {
+			t.Errorf("unexpected beanstalkd_last_scrape_success_timestamp_seconds %v for %s", got, addr)
+		}
+		if findMetric(families["beanstalkd_last_scrape_duration_seconds"], labels) == nil {
+			t.Fatalf("missing beanstalkd_last_scrape_duration_seconds for %s", addr)
+		}
+	}
+
+	errors := families["beanstalkd_exporter_scrape_connection_errors_total"]
+	if errors == nil || errors.GetMetric()[0].GetCounter().GetValue() == 0 {
+		t.Errorf("expected connection errors for unreachable server %s", dead)
+	}
+}
+
+func TestExporterPolling(t *testing.T) {
+	mapper = newTubeMapper()
+
+	server := newFakeBeanstalkd(t,
+		map[string]string{"current-jobs-ready": "3"},
+		map[string]map[string]string{"default": {"current-jobs-ready": "3"}},
+	)
+	e := NewExporter(server.addr())
+	e.polling = true
+
+	// Nothing is served before the first poll.
+	families := gather(t, e)
+	if families["beanstalkd_current_jobs_ready"] != nil {
+		t.Fatalf("unexpected current_jobs_ready before the first poll")
+	}
+
+	e.poll(time.Second)
+	e.Close()
+	server.close()
+
+	// The latest poll is served even though the server is gone.
+	families = gather(t, e)
+	if findMetric(families["beanstalkd_current_jobs_ready"], map[string]string{"instance": server.addr()}) == nil {
+		t.Fatalf("missing current_jobs_ready from the latest poll")
+	}
+	if families["beanstalkd_exporter_snapshot_age_seconds"] == nil {
+		t.Fatalf("missing beanstalkd_exporter_snapshot_age_seconds")
+	}
+}
+
+func TestExporterPollingSilentServer(t *testing.T) {
+	mapper = newTubeMapper()
+
+	server := newFakeBeanstalkd(t,
+		map[string]string{"current-jobs-ready": "3"},
+		map[string]map[string]string{"default": {"current-jobs-ready": "3"}},
+	)
+	defer server.close()
+	silent := newSilentListener(t)
+	defer silent.Close()
+
+	e := NewExporter(server.addr(), silent.Addr().String())
+	defer e.Close()
+	e.StartPolling(200 * time.Millisecond)
+
+	// Every poll ends in time despite the silent server.
+	time.Sleep(time.Second)
+	families := gather(t, e)
+	if families["beanstalkd_exporter_snapshot_age_seconds"] == nil {
+		t.Fatalf("missing beanstalkd_exporter_snapshot_age_seconds")
+	}
+	if findMetric(families["beanstalkd_current_jobs_ready"], map[string]string{"instance": server.addr()}) == nil {
+		t.Fatalf("missing current_jobs_ready for %s", server.addr())
+	}
+	m := findMetric(families["beanstalkd_up"], map[string]string{"instance": silent.Addr().String()})
+	if m == nil || m.GetGauge().GetValue() != 0 {
+		t.Fatalf("Expected %s down, got %v", silent.Addr(), m)
+	}
+}
+
+func TestExporterTubeStatWorkers(t *testing.T) {
+	mapper = newTubeMapper()
+
+	tubes := map[string]map[string]string{}
+	for i := 0; i < 20; i++ {
+		tubes[fmt.Sprintf("tube-%d", i)] = map[string]string{"current-jobs-ready": fmt.Sprint(i)}
+	}
+	server := newFakeBeanstalkd(t, map[string]string{"current-jobs-ready": "0"}, tubes)
+	defer server.close()
+
+	e := NewExporter(server.addr())
+	e.SetNumTubeStatWorkers(3)
+	defer e.Close()
+	families := gather(t, e)
+
+	for name, stats := range tubes {
+		m := findMetric(families["beanstalkd_tube_current_jobs_ready"], map[string]string{"tube": name})
+		if m == nil {
+			t.Fatalf("missing tube_current_jobs_ready for %s", name)
+		}
+		if got := fmt.Sprint(m.GetGauge().GetValue()); got != stats["current-jobs-ready"] {
+			t.Fatalf("tube_current_jobs_ready for %s: expected %s, got %s", name, stats["current-jobs-ready"], got)
+		}
+	}
+	if len(e.servers[0].workerConns) != 3 {
+		t.Fatalf("Expected 3 worker connections, got %d", len(e.servers[0].workerConns))
+	}
+
+	var fetched float64
+	for _, m := range families["beanstalkd_exporter_tube_stat_worker_tubes_total"].GetMetric() {
+		fetched += m.GetCounter().GetValue()
+	}
+	if fetched != float64(len(tubes)) {
+		t.Fatalf("Expected %d tubes fetched by the workers, got %v", len(tubes), fetched)
+	}
+}
+
+func TestExporterCounters(t *testing.T) {
+	mapper = newTubeMapper()
+
+	server := newFakeBeanstalkd(t,
+		map[string]string{"cmd-put": "10", "current-jobs-ready": "3"},
+		map[string]map[string]string{"default": {"total-jobs": "10", "current-jobs-ready": "3"}},
+	)
+	defer server.close()
+
+	scenarios := []struct {
+		useCounters bool
+		types       map[string]dto.MetricType
+	}{
+		{
+			useCounters: false,
+			types: map[string]dto.MetricType{
+				"cmd_put":                 dto.MetricType_GAUGE,
+				"current_jobs_ready":      dto.MetricType_GAUGE,
+				"tube_total_jobs":         dto.MetricType_GAUGE,
+				"tube_current_jobs_ready": dto.MetricType_GAUGE,
+			},
+		},
+		{
+			useCounters: true,
+			types: map[string]dto.MetricType{
+				"beanstalkd_cmd_put_total":           dto.MetricType_COUNTER,
+				"beanstalkd_current_jobs_ready":      dto.MetricType_GAUGE,
+				"beanstalkd_tube_total_jobs_total":   dto.MetricType_COUNTER,
+				"beanstalkd_tube_current_jobs_ready": dto.MetricType_GAUGE,
+				"cmd_put":                            dto.MetricType_GAUGE,
+				"tube_total_jobs":                    dto.MetricType_GAUGE,
+			},
+		},
+	}
+
+	for i, scenario := range scenarios {
+		e := NewExporter(server.addr())
+		e.SetUseCounters(scenario.useCounters)
+		e.SetLegacyNames(true)
+		families := gather(t, e)
+		e.Close()
+
+		for name, metricType := range scenario.types {
+			family := families[name]
+			if family == nil {
+				t.Fatalf("%d. missing %s", i, name)
+			}
+			if family.GetType() != metricType {
+				t.Fatalf("%d. Expected %s to be a %s, got %s", i, name, metricType, family.GetType())
+			}
+		}
+	}
+}
+
+func TestExporterNamespace(t *testing.T) {
+	mapper = newTubeMapper()
+
+	server := newFakeBeanstalkd(t,
+		map[string]string{"current-jobs-ready": "3"},
+		map[string]map[string]string{"default": {"current-jobs-ready": "3"}},
+	)
+	defer server.close()
+
+	scenarios := []struct {
+		namespace   string
+		legacyNames bool
+		present     []string
+		absent      []string
+	}{
+		{
+			namespace:   "beanstalkd",
+			legacyNames: true,
+			present:     []string{"beanstalkd_current_jobs_ready", "beanstalkd_tube_current_jobs_ready", "current_jobs_ready", "tube_current_jobs_ready"},
+		},
+		{
+			namespace:   "queue",
+			legacyNames: false,
+			present:     []string{"queue_current_jobs_ready", "queue_tube_current_jobs_ready", "beanstalkd_up"},
+			absent:      []string{"beanstalkd_current_jobs_ready", "current_jobs_ready", "tube_current_jobs_ready", "queue_up"},
+		},
+		{
+			namespace:   "",
+			legacyNames: true,
+			present:     []string{"current_jobs_ready", "tube_current_jobs_ready", "beanstalkd_up"},
+			absent:      []string{"up"},
+		},
+	}
+
+	for i, scenario := range scenarios {
+		e := NewExporter(server.addr())
+		e.SetNamespace(scenario.namespace)
+		e.SetLegacyNames(scenario.legacyNames)
+		families := gather(t, e)
+		e.Close()
+
+		for _, name := range scenario.present {
+			if family := families[name]; family == nil || len(family.GetMetric()) != 1 {
+				t.Fatalf("%d. Expected a single %s, got %v", i, name, family)
+			}
+		}
+		for _, name := range scenario.absent {
+			if families[name] != nil {
+				t.Fatalf("%d. unexpected %s", i, name)
+			}
+		}
+	}
+}
+
+func TestExporterInfo(t *testing.T) {
+	mapper = newTubeMapper()
+
+	scenarios := []struct {
+		version  string
+		hostname string
+		labels   map[string]string
+	}{
+		// beanstalkd quotes the version since 1.11
+		{version: `"1.12"`, hostname: "queue-1", labels: map[string]string{"version": "1.12", "hostname": "queue-1"}},
+		// string stats looking like numbers
+		{version: "1.10", hostname: "12345", labels: map[string]string{"version": "1.10", "hostname": "12345"}},
+	}
+
+	for i, scenario := range scenarios {
+		server := newFakeBeanstalkd(t,
+			map[string]string{
+				"current-jobs-ready": "3",
+				"version":            scenario.version,
+				"hostname":           scenario.hostname,
+				"id":                 "3a5d4b0c8e1f2a7b",
+				"os":                 "#1 SMP",
+				"platform":           "x86_64",
+			},
+			map[string]map[string]string{"default": {"name": "default", "current-jobs-ready": "3"}},
+		)
+
+		e := NewExporter(server.addr())
+		families := gather(t, e)
+		e.Close()
+		server.close()
+
+		family := families["beanstalkd_info"]
+		if family == nil || len(family.GetMetric()) != 1 {
+			t.Fatalf("%d. Expected a single beanstalkd_info, got %v", i, family)
+		}
+		m := family.GetMetric()[0]
+		if m.GetGauge().GetValue() != 1 {
+			t.Fatalf("%d. Expected beanstalkd_info to be 1, got %v", i, m.GetGauge().GetValue())
+		}
+		labels := map[string]string{
+			"instance": server.addr(),
+			"id":       "3a5d4b0c8e1f2a7b",
+			"os":       "#1 SMP",
+			"platform": "x86_64",
+		}
+		for label, value := range scenario.labels {
+			labels[label] = value
+		}
+		for label, want := range labels {
+			if got := labelValue(m, label); got != want {
+				t.Fatalf("%d. Expected label %s to be %q, got %q", i, label, want, got)
+			}
+		}
+
+		for _, name := range []string{"beanstalkd_version", "version", "beanstalkd_hostname", "hostname", "beanstalkd_platform", "platform", "beanstalkd_tube_name", "tube_name"} {
+			if families[name] != nil {
+				t.Fatalf("%d. unexpected %s", i, name)
+			}
+		}
+		if families["beanstalkd_current_jobs_ready"] == nil {
+			t.Fatalf("%d. missing beanstalkd_current_jobs_ready", i)
+		}
+	}
+}
+
+func TestExporterRestarts(t *testing.T) {
+	mapper = newTubeMapper()
+
+	server := newFakeBeanstalkd(t,
+		map[string]string{"id": "a", "uptime": "100"},
+		map[string]map[string]string{},
+	)
+	defer server.close()
+
+	e := NewExporter(server.addr())
+	defer e.Close()
+
+	scenarios := []struct {
+		id       string
+		restarts float64
+	}{
+		{id: "a", restarts: 0},
+		{id: "a", restarts: 0},
+		{id: "b", restarts: 1},
+		{id: "b", restarts: 1},
+		{id: "c", restarts: 2},
+	}
+
+	var lastStartTime float64
+	for i, scenario := range scenarios {
+		server.setStats(map[string]string{"id": scenario.id, "uptime": "100"})
+		families := gather(t, e)
+
+		family := families["beanstalkd_restarts_total"]
+		if family == nil || len(family.GetMetric()) != 1 {
+			t.Fatalf("%d. Expected a single beanstalkd_restarts_total, got %v", i, family)
+		}
+		if got := family.GetMetric()[0].GetCounter().GetValue(); got != scenario.restarts {
+			t.Fatalf("%d. Expected %v restarts, got %v", i, scenario.restarts, got)
+		}
+
+		family = families["beanstalkd_start_time_seconds"]
+		if family == nil || len(family.GetMetric()) != 1 {
+			t.Fatalf("%d. Expected a single beanstalkd_start_time_seconds, got %v", i, family)
+		}
+		expected := float64(time.Now().Unix() - 100)
+		got := family.GetMetric()[0].GetGauge().GetValue()
+		if got < expected-5 || got > expected+5 {
+			t.Fatalf("%d. Expected a start time around %v, got %v", i, expected, got)
+		}
+		// the start time of a process doesn't change between scrapes
+		if i > 0 && scenario.id == scenarios[i-1].id && got != lastStartTime {
+			t.Fatalf("%d. Expected the start time %v of the last scrape, got %v", i, lastStartTime, got)
+		}
+		lastStartTime = got
+	}
+}
+
+func TestExporterTubeFilter(t *testing.T) {
+	mapper = newTubeMapper()
+
+	server := newFakeBeanstalkd(t,
+		map[string]string{},
+		map[string]map[string]string{
+			"default": {"current-jobs-ready": "1"},
+			"user-1":  {"current-jobs-ready": "2"},
+			"user-2":  {"current-jobs-ready": "3"},
+		},
+	)
+	defer server.close()
+
+	filter, err := newTubeFilter("", "user-.*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := NewExporter(server.addr())
+	defer e.Close()
+	e.SetTubeFilter(filter)
+	families := gather(t, e)
+
+	family := families["beanstalkd_tube_current_jobs_ready"]
+	if family == nil || len(family.GetMetric()) != 1 || labelValue(family.GetMetric()[0], "tube") != "default" {
+		t.Fatalf("Expected only the default tube, got %v", family)
+	}
+
+	filtered := families["beanstalkd_exporter_tubes_filtered_total"]
+	if filtered == nil || len(filtered.GetMetric()) != 1 {
+		t.Fatalf("Expected a single beanstalkd_exporter_tubes_filtered_total, got %v", filtered)
+	}
+	if got := filtered.GetMetric()[0].GetCounter().GetValue(); got != 2 {
+		t.Fatalf("Expected 2 filtered tubes, got %v", got)
+	}
+}
+
+func TestExporterMaxTubeSeries(t *testing.T) {
+	mapper = newTubeMapper()
+
+	server := newFakeBeanstalkd(t,
+		map[string]string{},
+		map[string]map[string]string{
+			"a": {"current-jobs-ready": "1"},
+			"b": {"current-jobs-ready": "2"},
+			"c": {"current-jobs-ready": "3"},
+			"d": {"current-jobs-ready": "4"},
+		},
+	)
+	defer server.close()
+
+	scenarios := []struct {
+		max      int
+		expected map[string]float64
+		overflow float64
+	}{
+		{
+			max:      0,
+			expected: map[string]float64{"a": 1, "b": 2, "c": 3, "d": 4},
+		},
+		{
+			max:      4,
+			expected: map[string]float64{"a": 1, "b": 2, "c": 3, "d": 4},
+			overflow: 0,
+		},
+		{
+			max:      2,
+			expected: map[string]float64{"a": 1, "b": 2, overflowTube: 7},
+			overflow: 2,
+		},
+	}
+
+	for i, scenario := range scenarios {
+		e := NewExporter(server.addr())
+		e.SetNumTubeStatWorkers(2)
+		e.SetMaxTubeSeries(scenario.max)
+		families := gather(t, e)
+		e.Close()
+
+		family := families["beanstalkd_tube_current_jobs_ready"]
+		if family == nil || len(family.GetMetric()) != len(scenario.expected) {
+			t.Fatalf("%d. Expected %d tubes, got %v", i, len(scenario.expected), family)
+		}
+		for tube, value := range scenario.expected {
+			m := findMetric(family, map[string]string{"tube": tube})
+			if m == nil {
+				t.Fatalf("%d. missing tube %s", i, tube)
+			}
+			if got := m.GetGauge().GetValue(); got != value {
+				t.Fatalf("%d. Expected %v for tube %s, got %v", i, value, tube, got)
+			}
+		}
+
+		overflow := families["beanstalkd_overflow_tubes"]
+		if scenario.max == 0 {
+			if overflow != nil {
+				t.Fatalf("%d. unexpected beanstalkd_overflow_tubes", i)
+			}
+			continue
+		}
+		if overflow == nil || len(overflow.GetMetric()) != 1 {
+			t.Fatalf("%d. Expected a single beanstalkd_overflow_tubes, got %v", i, overflow)
+		}
+		if got := overflow.GetMetric()[0].GetGauge().GetValue(); got != scenario.overflow {
+			t.Fatalf("%d. Expected %v overflow tubes, got %v", i, scenario.overflow, got)
+		}
+	}
+}
+
+func TestExporterMaxTubeSeriesAggregate(t *testing.T) {
+	mapper = newTubeMapper()
+	defer func() { mapper = newTubeMapper() }()
+	err := mapper.initFromString(`
+		emails-(\d+)
+		name="emails"
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := newFakeBeanstalkd(t,
+		map[string]string{},
+		map[string]map[string]string{
+			"default":  {"current-jobs-ready": "1"},
+			"emails-1": {"current-jobs-ready": "2"},
+			"emails-2": {"current-jobs-ready": "3"},
+			"queue":    {"current-jobs-ready": "4"},
+		},
+	)
+	defer server.close()
+
+	// emails-2 is past the limit of tubes but not of series, it's
+	// aggregated into the emails series instead of the overflow one.
+	mapper.setAggregate(true)
+	e := NewExporter(server.addr())
+	defer e.Close()
+	e.SetMaxTubeSeries(2)
+	families := gather(t, e)
+
+	expected := map[string]struct {
+		ready float64
+		count float64
+	}{
+		"default":    {ready: 1, count: 1},
+		"emails":     {ready: 5, count: 2},
+		overflowTube: {ready: 4, count: 1},
+	}
+	for _, name := range []string{"beanstalkd_tube_current_jobs_ready", "beanstalkd_tube_count"} {
+		if family := families[name]; family == nil || len(family.GetMetric()) != len(expected) {
+			t.Fatalf("Expected %d %s, got %v", len(expected), name, family)
+		}
+	}
+	for tube, want := range expected {
+		labels := map[string]string{"tube": tube}
+		if got := findMetric(families["beanstalkd_tube_current_jobs_ready"], labels).GetGauge().GetValue(); got != want.ready {
+			t.Fatalf("Expected %v jobs ready in %s, got %v", want.ready, tube, got)
+		}
+		if got := findMetric(families["beanstalkd_tube_count"], labels).GetGauge().GetValue(); got != want.count {
+			t.Fatalf("Expected %v tubes in %s, got %v", want.count, tube, got)
+		}
+	}
+	if got := families["beanstalkd_overflow_tubes"].GetMetric()[0].GetGauge().GetValue(); got != 1 {
+		t.Fatalf("Expected 1 overflow tube, got %v", got)
+	}
+}
+
+func TestExporterMappingAggregate(t *testing.T) {
+	mapper = newTubeMapper()
+	defer func() { mapper = newTubeMapper() }()
+	err := mapper.initFromString(`
+		emails-(\d+)
+		name="emails"
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := newFakeBeanstalkd(t,
+		map[string]string{},
+		map[string]map[string]string{
+			"emails-1": {"current-jobs-ready": "1", "pause": "10"},
+			"emails-2": {"current-jobs-ready": "2", "pause": "30"},
+			"emails-3": {"current-jobs-ready": "3", "pause": "20"},
+			"default":  {"current-jobs-ready": "4", "pause": "0"},
+		},
+	)
+	defer server.close()
+
+	mapper.setAggregate(true)
+	e := NewExporter(server.addr())
+	defer e.Close()
+	families := gather(t, e)
+
+	expected := map[string]struct {
+		ready float64
+		pause float64
+		count float64
+	}{
+		"emails":  {ready: 6, pause: 30, count: 3},
+		"default": {ready: 4, pause: 0, count: 1},
+	}
+	for _, name := range []string{"beanstalkd_tube_current_jobs_ready", "beanstalkd_tube_pause", "beanstalkd_tube_count"} {
+		if family := families[name]; family == nil || len(family.GetMetric()) != len(expected) {
+			t.Fatalf("Expected %d %s, got %v", len(expected), name, family)
+		}
+	}
+	for tube, want := range expected {
+		labels := map[string]string{"tube": tube}
+		if got := findMetric(families["beanstalkd_tube_current_jobs_ready"], labels).GetGauge().GetValue(); got != want.ready {
+			t.Fatalf("Expected %v jobs ready in %s, got %v", want.ready, tube, got)
+		}
+		if got := findMetric(families["beanstalkd_tube_pause"], labels).GetGauge().GetValue(); got != want.pause {
+			t.Fatalf("Expected a pause of %v in %s, got %v", want.pause, tube, got)
+		}
+		if got := findMetric(families["beanstalkd_tube_count"], labels).GetGauge().GetValue(); got != want.count {
+			t.Fatalf("Expected %v tubes in %s, got %v", want.count, tube, got)
+		}
+	}
+}
+
+func TestExporterMappingDrop(t *testing.T) {
+	mapper = newTubeMapper()
+	defer func() { mapper = newTubeMapper() }()
+	err := mapper.initFromString(`
+		tmp-.*
+		drop
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := newFakeBeanstalkd(t,
+		map[string]string{},
+		map[string]map[string]string{
+			"default": {"current-jobs-ready": "1"},
+			"tmp-1":   {"current-jobs-ready": "2"},
+		},
+	)
+	defer server.close()
+
+	e := NewExporter(server.addr())
+	defer e.Close()
+	families := gather(t, e)
+
+	family := families["beanstalkd_tube_current_jobs_ready"]
+	if family == nil || len(family.GetMetric()) != 1 || labelValue(family.GetMetric()[0], "tube") != "default" {
+		t.Fatalf("Expected only the default tube, got %v", family)
+	}
+	if got := families["beanstalkd_exporter_tube_stat_worker_tubes_total"].GetMetric()[0].GetCounter().GetValue(); got != 1 {
+		t.Fatalf("Expected the stats of a single tube to be fetched, got %v", got)
+	}
+	if got := families["beanstalkd_exporter_tubes_filtered_total"].GetMetric()[0].GetCounter().GetValue(); got != 1 {
+		t.Fatalf("Expected a single filtered tube, got %v", got)
+	}
+}
+
+func TestExporterMappingDropAlternation(t *testing.T) {
+	mapper = newTubeMapper()
+	defer func() { mapper = newTubeMapper() }()
+	err := mapper.initFromYAML(`
+mappings:
+  - match: tmp-.*|debug-.*
+    action: drop
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := newFakeBeanstalkd(t,
+		map[string]string{},
+		map[string]map[string]string{
+			"debug-1":          {"current-jobs-ready": "1"},
+			"prod-debug-queue": {"current-jobs-ready": "2"},
+			"tmp-1":            {"current-jobs-ready": "3"},
+		},
+	)
+	defer server.close()
+
+	e := NewExporter(server.addr())
+	defer e.Close()
+	families := gather(t, e)
+
+	// only prod-debug-queue, which doesn't start with any alternative, is kept
+	family := families["beanstalkd_tube_current_jobs_ready"]
+	if family == nil || len(family.GetMetric()) != 1 || labelValue(family.GetMetric()[0], "tube") != "prod-debug-queue" {
+		t.Fatalf("Expected only the prod-debug-queue tube, got %v", family)
+	}
+	if got := families["beanstalkd_exporter_tubes_filtered_total"].GetMetric()[0].GetCounter().GetValue(); got != 2 {
+		t.Fatalf("Expected 2 filtered tubes, got %v", got)
+	}
+}
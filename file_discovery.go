@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// fileSource is the discovery source of the servers listed in a targets file.
+const fileSource = "file"
+
+// targetGroup is a group of servers sharing the same labels, in the format of
+// Prometheus' file_sd_configs.
+type targetGroup struct {
+	Targets []string          `json:"targets" yaml:"targets"`
+	Labels  map[string]string `json:"labels" yaml:"labels"`
+}
+
+// fileDiscovery reads the servers to scrape from a JSON or YAML targets file.
+type fileDiscovery struct {
+	fileName string
+	update   func(targets []target)
+
+	readFailuresMetric prometheus.Counter
+}
+
+func newFileDiscovery(fileName string, update func(targets []target)) *fileDiscovery {
+	return &fileDiscovery{
+		fileName: fileName,
+		update:   update,
+		readFailuresMetric: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Namespace: "beanstalkd",
+				Subsystem: "exporter",
+				Name:      "file_sd_read_failures_total",
+				Help:      "The number of failed reads of the targets file.",
+			},
+		),
+	}
+}
+
+// refresh reads the targets file and updates the servers. On failure the
+// previously read servers are kept.
+func (d *fileDiscovery) refresh() error {
+	targets, err := readTargetsFromFile(d.fileName)
+	if err != nil {
+		d.readFailuresMetric.Inc()
+		return err
+	}
+	d.update(targets)
+	return nil
+}
+
+// run refreshes the servers every time the targets file changes, it never
+// returns.
+func (d *fileDiscovery) run() {
+	watchFile(d.fileName, watchDebounce, func() {
+		if err := d.refresh(); err != nil {
+			log.Errorf("Error reading targets file: %v", err)
+			return
+		}
+		log.Warn("Targets file reloaded successfully")
+	})
+}
+
+func readTargetsFromFile(fileName string) ([]target, error) {
+	contents, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	var groups []targetGroup
+	switch filepath.Ext(fileName) {
+	case ".json":
+		err = json.Unmarshal(contents, &groups)
+	case ".yml", ".yaml":
+		err = yaml.UnmarshalStrict(contents, &groups)
+	default:
+		return nil, fmt.Errorf("%s: unknown targets file extension, expected .json, .yml or .yaml", fileName)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", fileName, err)
+	}
+	return parseTargetGroups(groups)
+}
+
+func parseTargetGroups(groups []targetGroup) ([]target, error) {
+	var targets []target
+	for i, group := range groups {
+		labels := prometheus.Labels{}
+		for label, value := range group.Labels {
+			if !validLabelName(label) {
+				return nil, fmt.Errorf("group %d: invalid label name %q", i, label)
+			}
+			if reservedLabel(label) {
+				return nil, fmt.Errorf("group %d: label %q is reserved", i, label)
+			}
+			labels[label] = value
+		}
+		for _, address := range group.Targets {
+			targets = append(targets, target{address: address, labels: labels})
+		}
+	}
+	return targets, nil
+}
+
+// reservedLabel returns whether the label is set by the exporter itself, on
+// every metric, on the tube metrics or on the info metric, and can't be set by
+// a target. The name label of a tube mapping becomes the tube label.
+func reservedLabel(label string) bool {
+	return label == "instance" || label == "tube" || label == "name" || isInfoStat(label)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestReadTargetsFromFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "beanstalkd_exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	expected := []target{
+		{address: "beanstalkd-1:11300", labels: prometheus.Labels{"env": "production"}},
+		{address: "beanstalkd-2:11300", labels: prometheus.Labels{"env": "production"}},
+		{address: "beanstalkd-3:11300", labels: prometheus.Labels{}},
+	}
+	scenarios := []struct {
+		fileName string
+		contents string
+		bad      bool
+	}{
+		{
+			fileName: "targets.json",
+			contents: `[
+				{"targets": ["beanstalkd-1:11300", "beanstalkd-2:11300"], "labels": {"env": "production"}},
+				{"targets": ["beanstalkd-3:11300"]}
+			]`,
+		},
+		{
+			fileName: "targets.yml",
+			contents: `
+- targets: [beanstalkd-1:11300, beanstalkd-2:11300]
+  labels:
+    env: production
+- targets: [beanstalkd-3:11300]
+`,
+		},
+		// Unknown extension.
+		{fileName: "targets.conf", contents: `[]`, bad: true},
+		// Unknown field.
+		{fileName: "targets.yaml", contents: `[{hosts: [beanstalkd-1:11300]}]`, bad: true},
+		// Invalid label name.
+		{fileName: "targets.json", contents: `[{"targets": ["beanstalkd-1:11300"], "labels": {"0env": "x"}}]`, bad: true},
+		// Label name reserved by Prometheus.
+		{fileName: "targets.json", contents: `[{"targets": ["beanstalkd-1:11300"], "labels": {"__env": "x"}}]`, bad: true},
+		// Reserved label name.
+		{fileName: "targets.json", contents: `[{"targets": ["beanstalkd-1:11300"], "labels": {"instance": "x"}}]`, bad: true},
+		// Reserved mapping label.
+		{fileName: "targets.json", contents: `[{"targets": ["beanstalkd-1:11300"], "labels": {"name": "x"}}]`, bad: true},
+		// Reserved info label.
+		{fileName: "targets.json", contents: `[{"targets": ["beanstalkd-1:11300"], "labels": {"version": "x"}}]`, bad: true},
+	}
+
+	for i, scenario := range scenarios {
+		fileName := filepath.Join(dir, scenario.fileName)
+		if err := ioutil.WriteFile(fileName, []byte(scenario.contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+		targets, err := readTargetsFromFile(fileName)
+		if err != nil && !scenario.bad {
+			t.Fatalf("%d. Targets load error: %s", i, err)
+		}
+		if err == nil && scenario.bad {
+			t.Fatalf("%d. Expected bad targets file, but loaded ok", i)
+		}
+		if !scenario.bad && !reflect.DeepEqual(targets, expected) {
+			t.Fatalf("%d. Expected %v, got %v", i, expected, targets)
+		}
+	}
+}
+
+func TestExporterTargetLabels(t *testing.T) {
+	mapper = newTubeMapper()
+
+	server := newFakeBeanstalkd(t,
+		map[string]string{"current-jobs-ready": "1"},
+		map[string]map[string]string{"default": {"current-jobs-ready": "1"}},
+	)
+	defer server.close()
+
+	e := NewExporter()
+	e.SetTargets(fileSource, []target{
+		{address: server.addr(), labels: prometheus.Labels{"env": "production"}},
+	})
+	families := gather(t, e)
+
+	labels := map[string]string{"instance": server.addr(), "env": "production"}
+	if findMetric(families["beanstalkd_current_jobs_ready"], labels) == nil {
+		t.Errorf("missing current_jobs_ready with labels %v", labels)
+	}
+	labels["tube"] = "default"
+	if findMetric(families["beanstalkd_tube_current_jobs_ready"], labels) == nil {
+		t.Errorf("missing tube_current_jobs_ready with labels %v", labels)
+	}
+}
@@ -1,8 +1,11 @@
 package main
 
 import (
+	"crypto/tls"
+	"fmt"
 	"io"
 	"net"
+	"strings"
 	"sync"
 	"time"
 
@@ -12,16 +15,42 @@ import (
 type lazyConn struct {
 	m           sync.Mutex
 	conn        net.Conn
+	network     string
 	addr        string
+	tlsConfig   *tls.Config
 	dialTimeout time.Duration
 	readTimeout time.Duration
+	// deadline of the current scrape, zero for none, see SetDeadline
+	deadline time.Time
+
+	// expiry of the TLS certificate of the peer, zero without TLS
+	peerCertificateExpiry time.Time
 }
 
-func newLazyConn(addr string, dialTimeout time.Duration, readTimeout time.Duration) (io.ReadWriteCloser, error) {
+// newLazyConn connects to the given beanstalkd address before the deadline, if
+// any. Connections are made over TLS with tlsConfig when useTLS is set or the
+// address uses the tls:// scheme.
+func newLazyConn(addr string, dialTimeout time.Duration, readTimeout time.Duration, deadline time.Time, tlsConfig *tls.Config, useTLS bool) (*lazyConn, error) {
+	network, addr, err := parseAddress(addr)
+	if err != nil {
+		return nil, err
+	}
+	if network == "tls" {
+		network = "tcp"
+		useTLS = true
+	}
+	if !useTLS {
+		tlsConfig = nil
+	} else if tlsConfig == nil {
+		tlsConfig = &tls.Config{}
+	}
 	l := &lazyConn{
 		dialTimeout: dialTimeout,
 		readTimeout: readTimeout,
+		deadline:    deadline,
+		network:     network,
 		addr:        addr,
+		tlsConfig:   tlsConfig,
 	}
 	if err := l.connect(); err != nil {
 		return nil, err
@@ -29,26 +58,96 @@ func newLazyConn(addr string, dialTimeout time.Duration, readTimeout time.Durati
 	return l, nil
 }
 
+// parseAddress returns the network and the address to dial for a beanstalkd
+// address, which is one of unix:///path/to/socket, tcp://host:port,
+// tls://host:port or host:port. The returned network is unix, tcp or tls.
+func parseAddress(addr string) (network string, address string, err error) {
+	switch {
+	case strings.HasPrefix(addr, "unix://"):
+		network, address = "unix", strings.TrimPrefix(addr, "unix://")
+	case strings.HasPrefix(addr, "tcp://"):
+		network, address = "tcp", strings.TrimPrefix(addr, "tcp://")
+	case strings.HasPrefix(addr, "tls://"):
+		network, address = "tls", strings.TrimPrefix(addr, "tls://")
+	case strings.Contains(addr, "://"):
+		return "", "", fmt.Errorf("unsupported scheme in address %s", addr)
+	default:
+		network, address = "tcp", addr
+	}
+	if address == "" {
+		return "", "", fmt.Errorf("missing %s address in %s", network, addr)
+	}
+	return network, address, nil
+}
+
 func (l *lazyConn) connect() error {
-	conn, err := net.DialTimeout("tcp", l.addr, l.dialTimeout)
+	dialer := &net.Dialer{Timeout: l.dialTimeout, Deadline: l.deadline}
+	if l.tlsConfig == nil {
+		conn, err := dialer.Dial(l.network, l.addr)
+		if err != nil {
+			l.conn = nil
+			return err
+		}
+		l.conn = conn
+		return nil
+	}
+
+	conn, err := tls.DialWithDialer(dialer, l.network, l.addr, l.tlsConfig)
 	if err != nil {
 		l.conn = nil
 		return err
 	}
 	l.conn = conn
+	if certs := conn.ConnectionState().PeerCertificates; len(certs) > 0 {
+		l.peerCertificateExpiry = certs[0].NotAfter
+	}
 	return nil
 }
 
+// PeerCertificateExpiry returns the expiry time of the TLS certificate of the
+// peer, or the zero time if the connection doesn't use TLS.
+func (l *lazyConn) PeerCertificateExpiry() time.Time {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	return l.peerCertificateExpiry
+}
+
+// SetDeadline sets the deadline of all the following reads, writes and
+// reconnections, on top of the read timeout. The zero time means no deadline.
+func (l *lazyConn) SetDeadline(t time.Time) {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	l.deadline = t
+}
+
 func (l *lazyConn) withTimeout() net.Conn {
+	readDeadline := l.deadline
 	if l.readTimeout > 0 {
-		err := l.conn.SetReadDeadline(time.Now().Add(l.readTimeout))
-		if err != nil {
-			log.Warnf("unable to set timeout: %s", err)
+		timeout := time.Now().Add(l.readTimeout)
+		if readDeadline.IsZero() || timeout.Before(readDeadline) {
+			readDeadline = timeout
 		}
 	}
+	if err := l.conn.SetReadDeadline(readDeadline); err != nil {
+		log.Warnf("unable to set timeout: %s", err)
+	}
+	if err := l.conn.SetWriteDeadline(l.deadline); err != nil {
+		log.Warnf("unable to set timeout: %s", err)
+	}
 	return l.conn
 }
 
+// resetOnTimeout drops the connection after a timeout, since the response
+// may still arrive and be read as the one of the next command.
+func (l *lazyConn) resetOnTimeout(err error) {
+	if err, ok := err.(net.Error); ok && err.Timeout() {
+		l.conn.Close()
+		l.conn = nil
+	}
+}
+
 // Read implements the io.Reader interface and attempt
 // to reconnect to beanstalk in case of io.EOF.
 func (l *lazyConn) Read(p []byte) (n int, err error) {
@@ -67,6 +166,8 @@ func (l *lazyConn) Read(p []byte) (n int, err error) {
 		fallthrough
 	case err == io.ErrUnexpectedEOF:
 		l.conn = nil
+	default:
+		l.resetOnTimeout(err)
 	}
 	return n, err
 }
@@ -84,13 +185,22 @@ func (l *lazyConn) Write(p []byte) (n int, err error) {
 	}
 
 	n, err = l.withTimeout().Write(p)
-	if n == 0 && err != io.ErrClosedPipe {
+	l.resetOnTimeout(err)
+	if l.conn != nil && n == 0 && err != io.ErrClosedPipe {
 		l.conn = nil
 	}
 	return n, err
 }
 
-// Close the TCP connection.
+// Close the connection.
 func (l *lazyConn) Close() error {
-	return l.conn.Close()
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	if l.conn == nil {
+		return nil
+	}
+	err := l.conn.Close()
+	l.conn = nil
+	return err
 }
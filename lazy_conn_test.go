@@ -0,0 +1,59 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseAddress(t *testing.T) {
+	scenarios := []struct {
+		addr    string
+		network string
+		address string
+		bad     bool
+	}{
+		{addr: "localhost:11300", network: "tcp", address: "localhost:11300"},
+		{addr: "tcp://localhost:11300", network: "tcp", address: "localhost:11300"},
+		{addr: "unix:///run/beanstalkd.sock", network: "unix", address: "/run/beanstalkd.sock"},
+		{addr: "unix://", bad: true},
+		{addr: "udp://localhost:11300", bad: true},
+	}
+
+	for i, scenario := range scenarios {
+		network, address, err := parseAddress(scenario.addr)
+		if err != nil && !scenario.bad {
+			t.Fatalf("%d. Address parse error: %s", i, err)
+		}
+		if err == nil && scenario.bad {
+			t.Fatalf("%d. Expected bad address, but parsed ok", i)
+		}
+		if network != scenario.network || address != scenario.address {
+			t.Fatalf("%d. Expected %s %s, got %s %s", i, scenario.network, scenario.address, network, address)
+		}
+	}
+}
+
+func TestExporterUnixSocket(t *testing.T) {
+	mapper = newTubeMapper()
+
+	dir, err := ioutil.TempDir("", "beanstalkd_exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	socket := filepath.Join(dir, "beanstalkd.sock")
+	server := newFakeBeanstalkdOn(t, "unix", socket,
+		map[string]string{"current-jobs-ready": "2"},
+		map[string]map[string]string{"default": {"current-jobs-ready": "2"}},
+	)
+	defer server.close()
+
+	addr := "unix://" + socket
+	families := gather(t, NewExporter(addr))
+	if findMetric(families["beanstalkd_current_jobs_ready"], map[string]string{"instance": addr}) == nil {
+		t.Fatalf("missing current_jobs_ready for %s", addr)
+	}
+}
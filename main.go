@@ -1,88 +1,181 @@
 package main
 
 import (
+	"crypto/tls"
 	"flag"
+	"net"
 	"net/http"
+	"os"
+	"time"
 
-	"github.com/howeyc/fsnotify"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/model"
 )
 
 var (
-	address            = flag.String("beanstalkd.address", "localhost:11300", "Beanstalkd server address")
-	connectionTimeout  = flag.Duration("beanstalkd.connection-timeout", 0, "Timeout value for tcp connection to Beanstalkd")
-	logLevel           = flag.String("log.level", "warning", "The log level.")
-	mappingConfig      = flag.String("mapping-config", "", "A file that describes a mapping of tube names.")
-	sleepBetweenStats  = flag.Int("sleep-between-tube-stats", 5000, "The number of milliseconds to sleep between tube stats.")
-	numTubeStatWorkers = flag.Int("num-tube-stat-workers", 1, "The number of concurrent workers to use to fetch tube stats.")
-	listenAddress      = flag.String("web.listen-address", ":8080", "Address to listen on for web interface and telemetry.")
-	metricsPath        = flag.String("web.telemetry-path", "/metrics", "Path under which to expose metrics.")
+	address             = flag.String("beanstalkd.address", "localhost:11300", "Beanstalkd server address, host:port, tcp://host:port, tls://host:port or unix:///path/to/socket")
+	serversConfig       = flag.String("config", "", "A file that lists the beanstalkd servers to scrape, one address per line. Overrides -beanstalkd.address.")
+	fileSDConfig        = flag.String("file-sd-config", "", "A JSON or YAML file listing beanstalkd servers and their labels, in the format of Prometheus' file_sd_configs.")
+	srvRecord           = flag.String("beanstalkd.srv", "", "A DNS SRV record to discover beanstalkd servers from, e.g. _beanstalk._tcp.queue.internal.")
+	srvRefreshInterval  = flag.Duration("beanstalkd.srv-refresh-interval", 30*time.Second, "The interval between two resolutions of the DNS SRV record.")
+	tlsEnabled          = flag.Bool("beanstalkd.tls", false, "Connect to all Beanstalkd servers over TLS. Addresses with the tls:// scheme always use TLS.")
+	tlsCAFile           = flag.String("beanstalkd.tls.ca-file", "", "The CA bundle used to verify the Beanstalkd server certificates.")
+	tlsCertFile         = flag.String("beanstalkd.tls.cert-file", "", "The client certificate presented to Beanstalkd.")
+	tlsKeyFile          = flag.String("beanstalkd.tls.key-file", "", "The key of the client certificate.")
+	tlsServerName       = flag.String("beanstalkd.tls.server-name", "", "Override the server name used to verify the Beanstalkd server certificates.")
+	tlsInsecure         = flag.Bool("beanstalkd.tls.insecure-skip-verify", false, "Don't verify the Beanstalkd server certificates.")
+	connectionTimeout   = flag.Duration("beanstalkd.connection-timeout", 0, "Timeout value for tcp connection to Beanstalkd")
+	logLevel            = flag.String("log.level", "warning", "The log level.")
+	mappingConfig       = flag.String("mapping-config", "", "A file that describes a mapping of tube names, in the YAML format if its extension is .yml or .yaml, or a directory of such files merged in lexical order.")
+	mappingAggregate    = flag.Bool("mapping.aggregate", false, "Aggregate the stats of the tubes mapped to the same labels instead of exporting duplicate series.")
+	mappingCacheSize    = flag.Int("mapping.cache-size", 100000, "The maximum number of tube names whose mapping is cached until the next reload. 0 disables the cache.")
+	mappingPrefixIndex  = flag.Bool("mapping.prefix-index", false, "Index the mappings by the literal prefix of their regex, so that only the mappings whose prefix starts a tube name are tried.")
+	useCounters         = flag.Bool("metrics.counters", false, "Export the cumulative Beanstalkd stats as counters with a _total suffix instead of gauges.")
+	namespace           = flag.String("metrics.namespace", "beanstalkd", "The prefix of the names of the Beanstalkd server and tube metrics.")
+	legacyNames         = flag.Bool("metrics.legacy-names", false, "Also export the Beanstalkd server and tube metrics under their deprecated names, without namespace and as gauges.")
+	pollInterval        = flag.Duration("poll", 0, "Poll the Beanstalkd servers in the background at this interval and serve the latest stats, instead of scraping them on every request. 0 disables polling.")
+	sleepBetweenStats   = flag.Int("sleep-between-tube-stats", 5000, "Deprecated and ignored, the tube stats are fetched without sleeping in between.")
+	tubesInclude        = flag.String("tubes.include", "", "Only fetch the stats of the tubes whose name matches this regular expression.")
+	tubesExclude        = flag.String("tubes.exclude", "", "Don't fetch the stats of the tubes whose name matches this regular expression.")
+	maxTubeSeries       = flag.Int("tubes.max-series", 0, "The maximum number of tube series per Beanstalkd server, after mapping and aggregation, the stats of the tubes of the other series are summed into a single __overflow__ tube. 0 means no limit.")
+	numTubeStatWorkers  = flag.Int("num-tube-stat-workers", 1, "The number of concurrent workers to use to fetch tube stats.")
+	listenAddress       = flag.String("web.listen-address", ":8080", "Address to listen on for web interface and telemetry.")
+	metricsPath         = flag.String("web.telemetry-path", "/metrics", "Path under which to expose metrics.")
+	scrapeTimeoutOffset = flag.Duration("web.scrape-timeout-offset", 500*time.Millisecond, "Offset to subtract from the scrape timeout sent by Prometheus, to leave time to send the response.")
+	probePath           = flag.String("web.probe-path", "/probe", "Path under which to expose the probe endpoint.")
 )
 
 var (
-	mapper   *tubeMapper
-	registry *prometheus.Registry
+	mapper    *tubeMapper
+	registry  *prometheus.Registry
+	tlsConfig *tls.Config
+	filter    *tubeFilter
 )
 
 func watchConfig(fileName string, mapper *tubeMapper) {
-	watcher, err := fsnotify.NewWatcher()
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	err = watcher.WatchFlags(fileName, fsnotify.FSN_MODIFY)
-	if err != nil {
-		log.Fatal(err)
-	}
+	watchFile(fileName, watchDebounce, func() {
+		reloadMapping(fileName, mapper)
+	})
+}
 
-	for {
-		select {
-		case ev := <-watcher.Event:
-			log.Warnf("Config file changed (%s), attempting reload", ev)
-			err = mapper.initFromFile(fileName)
-			if err != nil {
-				log.Errorf("Error reloading config: %v", err)
-				mapper.configLoadsMetric.WithLabelValues("failure").Inc()
-			} else {
-				log.Warn("Config reloaded successfully")
-				mapper.configLoadsMetric.WithLabelValues("success").Inc()
-			}
-			// Re-add the file watcher since it can get lost on some changes. E.g.
-			// saving a file with vim results in a RENAME-MODIFY-DELETE event
-			// sequence, after which the newly written file is no longer watched.
-			err = watcher.WatchFlags(fileName, fsnotify.FSN_MODIFY)
-		case err := <-watcher.Error:
-			log.Errorf("Error watching config: %v", err)
-		}
-	}
+// newExporterFromFlags returns an exporter for the given servers, configured
+// with the command line flags.
+func newExporterFromFlags(addresses ...string) *Exporter {
+	exporter := NewExporter(addresses...)
+	exporter.SetConnectionTimeout(*connectionTimeout)
+	exporter.SetTLSConfig(tlsConfig, *tlsEnabled)
+	exporter.SetNumTubeStatWorkers(*numTubeStatWorkers)
+	exporter.SetUseCounters(*useCounters)
+	exporter.SetNamespace(*namespace)
+	exporter.SetLegacyNames(*legacyNames)
+	exporter.SetTubeFilter(filter)
+	exporter.SetMaxTubeSeries(*maxTubeSeries)
+	return exporter
 }
 
 func main() {
 	flag.Parse()
 
+	switch flag.Arg(0) {
+	case "":
+	case "convert-mapping":
+		if err := convertMappingCommand(flag.Args()[1:], os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	case "check-mapping":
+		if err := checkMappingCommand(flag.Args()[1:], os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	default:
+		log.Fatalf("Unknown command %s", flag.Arg(0))
+	}
+
 	if *logLevel == "debug" {
 		log.Base().SetLevel("debug")
 	}
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "sleep-between-tube-stats" {
+			log.Warnf("-sleep-between-tube-stats is deprecated and ignored")
+		}
+	})
+
+	// an empty namespace exports the metrics named after the stats
+	if !model.IsValidMetricName(model.LabelValue(*namespace + "_x")) {
+		log.Fatalf("Invalid metrics namespace %q", *namespace)
+	}
 
 	mapper = newTubeMapper()
+	mapper.setAggregate(*mappingAggregate)
+	mapper.setCacheSize(*mappingCacheSize)
+	mapper.setPrefixIndex(*mappingPrefixIndex)
 	if *mappingConfig != "" {
-		err := mapper.initFromFile(*mappingConfig)
+		err := mapper.reload(*mappingConfig)
 		if err != nil {
 			log.Fatal("Error loading mapping config:", err)
 		}
 		go watchConfig(*mappingConfig, mapper)
 	}
-	exporter := NewExporter(*address)
-	exporter.SetConnectionTimeout(*connectionTimeout)
+	reloadOnSIGHUP(*mappingConfig, mapper)
+	var addresses []string
+	if *srvRecord == "" && *fileSDConfig == "" {
+		addresses = []string{*address}
+	}
+	if *serversConfig != "" {
+		servers, err := readServersFromFile(*serversConfig)
+		if err != nil {
+			log.Fatal("Error loading servers config:", err)
+		}
+		if len(servers) == 0 {
+			log.Fatalf("No servers found in %s", *serversConfig)
+		}
+		addresses = servers
+	}
+
+	var err error
+	tlsConfig, err = newTLSConfig(*tlsCAFile, *tlsCertFile, *tlsKeyFile, *tlsServerName, *tlsInsecure)
+	if err != nil {
+		log.Fatal("Error loading TLS config:", err)
+	}
+
+	filter, err = newTubeFilter(*tubesInclude, *tubesExclude)
+	if err != nil {
+		log.Fatal("Error parsing tube filter:", err)
+	}
+
+	exporter := newExporterFromFlags(addresses...)
+	if *pollInterval > 0 {
+		exporter.StartPolling(*pollInterval)
+	}
 	registry = prometheus.NewRegistry()
-	registry.MustRegister(exporter)
 
-	http.Handle(*metricsPath, promhttp.HandlerFor(
-		registry,
-		promhttp.HandlerOpts{ErrorHandling: promhttp.ContinueOnError},
-	))
+	if *srvRecord != "" {
+		if *srvRefreshInterval <= 0 {
+			log.Fatalf("Invalid SRV refresh interval %s, it must be positive", *srvRefreshInterval)
+		}
+		discovery := newSRVDiscovery(*srvRecord, *srvRefreshInterval, net.DefaultResolver, func(targets []target) {
+			exporter.SetTargets(srvSource, targets)
+		})
+		registry.MustRegister(discovery.lookupFailuresMetric)
+		go discovery.run()
+	}
+
+	if *fileSDConfig != "" {
+		discovery := newFileDiscovery(*fileSDConfig, func(targets []target) {
+			exporter.SetTargets(fileSource, targets)
+		})
+		if err := discovery.refresh(); err != nil {
+			log.Fatal("Error loading targets file:", err)
+		}
+		registry.MustRegister(discovery.readFailuresMetric)
+		go discovery.run()
+	}
+
+	http.Handle(*metricsPath, metricsHandler(exporter))
+	http.HandleFunc(*probePath, probeHandler)
+	http.HandleFunc("/-/reload", reloadHandler(*mappingConfig, mapper))
 
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte(`
@@ -91,6 +184,7 @@ func main() {
               <body>
                 <h1>Beanstalkd Exporter</h1>
                 <p><a href='` + *metricsPath + `'>Metrics</a></p>
+                <p><a href='` + *probePath + `?target=localhost:11300'>Probe localhost:11300</a></p>
               </body>
             </html>
 		`),
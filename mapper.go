@@ -14,34 +14,115 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/binary"
 	"fmt"
-	"io/ioutil"
+	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	yaml "gopkg.in/yaml.v2"
 )
 
 var (
 	identifierRE = `[a-zA-Z_-][a-zA-Z0-9_-]+`
 
-	labelLineRE = regexp.MustCompile(`^(` + identifierRE + `)\s*=\s*"(.*)"$`)
+	labelLineRE = regexp.MustCompile(`^([^\s=]+)\s*=\s*"(.*)"$`)
 	tubeNameRE  = regexp.MustCompile(`^` + identifierRE + `$`)
 )
 
 type tubeMapping struct {
+	// the regex as written in the config, without anchors
+	match  string
 	regex  *regexp.Regexp
 	labels prometheus.Labels
+	// whether the matching tubes are dropped
+	drop bool
+	// the line of the regex in a legacy config, or of the rule in a YAML
+	// config, 0 if unknown
+	line int
+	// the file of the mapping, in a directory of mapping files
+	file string
 }
 
-type tubeMapper struct {
-	mappings  []tubeMapping
+// validate checks that the mapping either drops tubes or sets their name.
+func (mapping *tubeMapping) validate() error {
+	if mapping.drop {
+		if len(mapping.labels) != 0 {
+			return fmt.Errorf("tube mapping can't both drop tubes and set labels")
+		}
+		return nil
+	}
+	if len(mapping.labels) == 0 {
+		return fmt.Errorf("tube mapping didn't set any labels")
+	}
+	if _, ok := mapping.labels["name"]; !ok {
+		return fmt.Errorf("tube mapping didn't set a tube name")
+	}
+	return nil
+}
+
+// yamlMappingConfig is the YAML mapping config: a list of rules, the first one
+// matching a tube is applied.
+type yamlMappingConfig struct {
+	Mappings []yamlMapping `yaml:"mappings"`
+}
+
+type yamlMapping struct {
+	Match  string            `yaml:"match"`
+	Labels map[string]string `yaml:"labels,omitempty"`
+	// map, the default, or drop
+	Action string `yaml:"action,omitempty"`
+}
+
+// mappingSnapshot is a loaded mapping config. Apart from its cache it's never
+// modified, a reload replaces it as a whole so that a scrape sees consistent
+// mappings and the cache is invalidated.
+type mappingSnapshot struct {
+	mappings []tubeMapping
+	// the labels set by any mapping, except the name
 	allLabels []string
-	mutex     sync.Mutex
+	// the hash of the config files
+	hash [sha256.Size]byte
 
-	configLoadsMetric   *prometheus.CounterVec
-	mappingsCountMetric prometheus.Gauge
+	// the mappings by literal prefix, nil when disabled
+	index *prefixIndex
+
+	// the results of the mapping by tube name, when cacheSize isn't 0
+	cacheSize  int
+	cacheMutex sync.RWMutex
+	cache      map[string]mappingResult
+}
+
+// mappingResult is the mapping matching a tube, if any, and the labels it
+// sets. The labels are shared and must not be modified.
+type mappingResult struct {
+	mapping *tubeMapping
+	labels  prometheus.Labels
+}
+
+type tubeMapper struct {
+	// the active *mappingSnapshot, read without locking on every scrape
+	config atomic.Value
+	// whether the stats of the tubes mapped to the same labels are aggregated
+	aggregate bool
+	// the size of the mapping cache of the next configs, 0 disables it
+	cacheSize int
+	// whether the next configs index the mappings by literal prefix
+	usePrefixIndex bool
+	mutex          sync.RWMutex
+
+	configLoadsMetric       *prometheus.CounterVec
+	mappingsCountMetric     prometheus.Gauge
+	lastReloadMetric        prometheus.Gauge
+	lastReloadSuccessMetric prometheus.Gauge
+	configHashMetric        prometheus.Gauge
 }
 
 type configLoadStates int
@@ -49,10 +130,11 @@ type configLoadStates int
 const (
 	searching configLoadStates = iota
 	tubeDefinition
+	skipping
 )
 
 func newTubeMapper() *tubeMapper {
-	return &tubeMapper{
+	m := &tubeMapper{
 		configLoadsMetric: prometheus.NewCounterVec(
 			prometheus.CounterOpts{
 				Namespace: "beanstalkd",
@@ -68,110 +150,519 @@ func newTubeMapper() *tubeMapper {
 			Name:      "loaded_mappings_count",
 			Help:      "The number of configured metric mappings.",
 		}),
+		lastReloadMetric: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "beanstalkd",
+			Subsystem: "exporter",
+			Name:      "config_last_reload_timestamp_seconds",
+			Help:      "The time of the last configuration reload, in seconds since the epoch.",
+		}),
+		lastReloadSuccessMetric: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "beanstalkd",
+			Subsystem: "exporter",
+			Name:      "config_last_reload_successful",
+			Help:      "Whether the last configuration reload was successful.",
+		}),
+		configHashMetric: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "beanstalkd",
+			Subsystem: "exporter",
+			Name:      "config_hash",
+			Help:      "A hash of the active mapping configuration.",
+		}),
 	}
+	m.config.Store(newMappingSnapshot(nil, sha256.Sum256(nil)))
+	// the initial empty config is valid, whether or not a config is loaded
+	m.lastReloadSuccessMetric.Set(1)
+	return m
 }
 
+// newMappingSnapshot returns the config made of the mappings, given the hash of
+// the files they were parsed from.
+func newMappingSnapshot(mappings []tubeMapping, hash [sha256.Size]byte) *mappingSnapshot {
+	allLabels := map[string]bool{}
+	for _, mapping := range mappings {
+		for label := range mapping.labels {
+			allLabels[label] = true
+		}
+	}
+	delete(allLabels, "name")
+
+	labelNames := make([]string, 0, len(allLabels))
+	for label := range allLabels {
+		labelNames = append(labelNames, label)
+	}
+	sort.Strings(labelNames)
+
+	return &mappingSnapshot{
+		mappings:  mappings,
+		allLabels: labelNames,
+		hash:      hash,
+	}
+}
+
+// newSnapshot returns the config made of the mappings, with the cache and
+// index options of the mapper.
+func (m *tubeMapper) newSnapshot(mappings []tubeMapping, hash [sha256.Size]byte) *mappingSnapshot {
+	config := newMappingSnapshot(mappings, hash)
+
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	if m.usePrefixIndex {
+		config.index = newPrefixIndex(mappings)
+	}
+	if m.cacheSize > 0 {
+		config.cacheSize = m.cacheSize
+		config.cache = map[string]mappingResult{}
+	}
+	return config
+}
+
+// initFromString loads a mapping config in the legacy format. The current
+// config is kept if it's invalid.
 func (m *tubeMapper) initFromString(fileContents string) error {
+	mappings, err := parseMappings(fileContents)
+	if err != nil {
+		return err
+	}
+	m.setConfig(m.newSnapshot(mappings, sha256.Sum256([]byte(fileContents))))
+	return nil
+}
+
+// initFromYAML loads a mapping config in the YAML format. The current config
+// is kept if it's invalid.
+func (m *tubeMapper) initFromYAML(fileContents string) error {
+	mappings, err := parseYAMLMappings(fileContents)
+	if err != nil {
+		return err
+	}
+	m.setConfig(m.newSnapshot(mappings, sha256.Sum256([]byte(fileContents))))
+	return nil
+}
+
+// parseMappings parses a mapping config in the legacy format: blocks made of a
+// regex line followed by label lines, or by a drop line, separated by empty
+// lines. Parsing goes on after an invalid block, so that all the errors are
+// reported.
+func parseMappings(fileContents string) ([]tubeMapping, error) {
 	lines := strings.Split(fileContents, "\n")
 	state := searching
 
-	allLabels := map[string]int{}
-
+	var errs mappingErrors
 	parsedMappings := []tubeMapping{}
 	currentMapping := tubeMapping{labels: prometheus.Labels{}}
+
+	// endMapping validates the current mapping, errors are reported on the
+	// line of its regex
+	endMapping := func() {
+		if state == tubeDefinition {
+			if err := currentMapping.validate(); err != nil {
+				errs = append(errs, fmt.Errorf("Line %d: %s", currentMapping.line, err))
+			} else {
+				parsedMappings = append(parsedMappings, currentMapping)
+			}
+		}
+		state = searching
+		currentMapping = tubeMapping{labels: prometheus.Labels{}}
+	}
+
 	for i, line := range lines {
+		n := i + 1
 		line := strings.TrimSpace(line)
 
+		if line == "" {
+			endMapping()
+			continue
+		}
+
 		switch state {
 		case searching:
-			if line == "" {
+			regex, err := compileTubeRegex(line)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("Line %d: invalid tube regex: %s", n, err))
+				state = skipping
 				continue
 			}
-			currentMapping.regex = regexp.MustCompile("^" + line + "$")
+			currentMapping.match = line
+			currentMapping.regex = regex
+			currentMapping.line = n
 			state = tubeDefinition
 
 		case tubeDefinition:
-			if line == "" {
-				if len(currentMapping.labels) == 0 {
-					return fmt.Errorf("Line %d: tube mapping didn't set any labels", i)
-				}
-				if _, ok := currentMapping.labels["name"]; !ok {
-					return fmt.Errorf("Line %d: tube mapping didn't set a tube name", i)
-				}
-
-				parsedMappings = append(parsedMappings, currentMapping)
-
-				state = searching
-				currentMapping = tubeMapping{labels: prometheus.Labels{}}
+			if line == "drop" {
+				currentMapping.drop = true
 				continue
 			}
 
 			matches := labelLineRE.FindStringSubmatch(line)
 			if len(matches) != 3 {
-				return fmt.Errorf("Line %d: expected label mapping line, got: %s", i, line)
+				errs = append(errs, fmt.Errorf("Line %d: expected label mapping line, got: %s", n, line))
+				state = skipping
+				continue
 			}
 			label, value := matches[1], matches[2]
+			if !validLabelName(label) {
+				errs = append(errs, fmt.Errorf("Line %d: invalid label name '%s'", n, label))
+				state = skipping
+				continue
+			}
 			if label == "name" && !tubeNameRE.MatchString(value) {
-				return fmt.Errorf("Line %d: tube name '%s' doesn't match regex '%s'", i, value, tubeNameRE)
+				errs = append(errs, fmt.Errorf("Line %d: tube name '%s' doesn't match regex '%s'", n, value, tubeNameRE))
+				state = skipping
+				continue
 			}
 			currentMapping.labels[label] = value
-			allLabels[label] = 1
+
+		case skipping:
+			// the rest of an invalid mapping
+
 		default:
 			panic("illegal state")
 		}
 	}
+	endMapping()
 
-	m.mutex.Lock()
-	defer m.mutex.Unlock()
-	m.mappings = parsedMappings
+	if len(errs) != 0 {
+		return nil, errs
+	}
+	return parsedMappings, nil
+}
 
-	// get the list of unique labels across all mappings
-	delete(allLabels, "name")
-	labelNames := make([]string, len(allLabels))
-	i := 0
-	for k := range allLabels {
-		labelNames[i] = k
-		i++
+// compileTubeRegex compiles the regex of a mapping, matching whole tube names.
+// The regex is grouped so that the anchors apply to all of its alternatives.
+// It's first compiled alone, for the errors to show the regex as written.
+func compileTubeRegex(match string) (*regexp.Regexp, error) {
+	if _, err := regexp.Compile(match); err != nil {
+		return nil, err
 	}
-	m.allLabels = labelNames
+	return regexp.Compile("^(?:" + match + ")$")
+}
+
+// validLabelName returns whether the label name is a valid Prometheus label
+// name, not reserved for Prometheus' internal use by its __ prefix.
+func validLabelName(label string) bool {
+	return model.LabelName(label).IsValid() && !strings.HasPrefix(label, model.ReservedLabelPrefix)
+}
 
-	m.mappingsCountMetric.Set(float64(len(parsedMappings)))
+// mappingErrors are all the errors found in a mapping config.
+type mappingErrors []error
 
-	return nil
+func (errs mappingErrors) Error() string {
+	messages := make([]string, len(errs))
+	for i, err := range errs {
+		messages[i] = err.Error()
+	}
+	return strings.Join(messages, "\n")
 }
 
+// parseYAMLMappings parses a mapping config in the YAML format. All the
+// invalid rules are reported, on the line where they start when it can be
+// found, by their number from 1 otherwise.
+func parseYAMLMappings(fileContents string) ([]tubeMapping, error) {
+	var config yamlMappingConfig
+	if err := yaml.UnmarshalStrict([]byte(fileContents), &config); err != nil {
+		return nil, err
+	}
+
+	lines := yamlMappingLines(fileContents)
+	if len(lines) != len(config.Mappings) {
+		lines = nil
+	}
+
+	var errs mappingErrors
+	parsedMappings := []tubeMapping{}
+	for i, rule := range config.Mappings {
+		mapping, err := parseYAMLMapping(rule)
+		switch {
+		case err != nil && lines != nil:
+			errs = append(errs, fmt.Errorf("Line %d: %s", lines[i], err))
+			continue
+		case err != nil:
+			errs = append(errs, fmt.Errorf("Mapping %d (match '%s'): %s", i+1, rule.Match, err))
+			continue
+		case lines != nil:
+			mapping.line = lines[i]
+		}
+		parsedMappings = append(parsedMappings, mapping)
+	}
+
+	if len(errs) != 0 {
+		return nil, errs
+	}
+	return parsedMappings, nil
+}
+
+// yamlMappingLines returns the lines, from 1, where the rules of a YAML mapping
+// config start, as yaml.v2 doesn't report the position of decoded values. Only
+
+// rules written in the block style, one "- " item each, are found.
+func yamlMappingLines(fileContents string) []int {
+	var lines []int
+	inMappings := false
+	indent := -1
+	for i, line := range strings.Split(fileContents, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		depth := len(line) - len(strings.TrimLeft(line, " "))
+		isItem := trimmed == "-" || strings.HasPrefix(trimmed, "- ")
+		switch {
+		case depth == 0 && !isItem:
+			inMappings = strings.HasPrefix(trimmed, "mappings:")
+		case !inMappings || !isItem:
+		case indent == -1 || depth == indent:
+			indent = depth
+			lines = append(lines, i+1)
+		}
+	}
+	return lines
+}
+
+func parseYAMLMapping(rule yamlMapping) (tubeMapping, error) {
+	mapping := tubeMapping{match: rule.Match, labels: prometheus.Labels{}}
+	if rule.Match == "" {
+		return mapping, fmt.Errorf("missing match")
+	}
+	regex, err := compileTubeRegex(rule.Match)
+	if err != nil {
+		return mapping, fmt.Errorf("invalid tube regex: %s", err)
+	}
+	mapping.regex = regex
+
+	switch rule.Action {
+	case "", "map":
+	case "drop":
+		mapping.drop = true
+	default:
+		return mapping, fmt.Errorf("unknown action '%s', expected map or drop", rule.Action)
+	}
+
+	for label, value := range rule.Labels {
+		if !validLabelName(label) {
+			return mapping, fmt.Errorf("invalid label name '%s'", label)
+		}
+		if label == "name" && !tubeNameRE.MatchString(value) {
+			return mapping, fmt.Errorf("tube name '%s' doesn't match regex '%s'", value, tubeNameRE)
+		}
+		mapping.labels[label] = value
+	}
+	return mapping, mapping.validate()
+}
+
+// setConfig replaces the config.
+func (m *tubeMapper) setConfig(config *mappingSnapshot) {
+	m.config.Store(config)
+
+	m.mappingsCountMetric.Set(float64(len(config.mappings)))
+	m.configHashMetric.Set(hashValue(config.hash))
+}
+
+// hashValue returns the first 48 bits of the hash, which fit in the mantissa
+// of a float64.
+func hashValue(hash [sha256.Size]byte) float64 {
+	var b [8]byte
+	copy(b[2:], hash[:6])
+	return float64(binary.BigEndian.Uint64(b[:]))
+}
+
+// current returns the active config.
+func (m *tubeMapper) current() *mappingSnapshot {
+	return m.config.Load().(*mappingSnapshot)
+}
+
+// initFromFile loads a mapping config file, in the YAML format if its
+// extension is .yml or .yaml and in the legacy format otherwise. Given a
+// directory, the mappings of all its files are merged in lexical order. The
+// current config is kept if any file is invalid.
 func (m *tubeMapper) initFromFile(fileName string) error {
-	mappingStr, err := ioutil.ReadFile(fileName)
+	files, hash, err := readConfigFiles(fileName)
 	if err != nil {
 		return err
 	}
-	return m.initFromString(string(mappingStr))
+	fragments := len(files) != 1 || files[0].path != fileName
+
+	var errs mappingErrors
+	mappings := []tubeMapping{}
+	for _, f := range files {
+		file := f.path
+		parse := parseMappings
+		if isYAMLFile(file) {
+			parse = parseYAMLMappings
+		}
+		parsed, err := parse(string(f.contents))
+		if err != nil && !fragments {
+			return err
+		}
+		if err != nil {
+			// report the file of the errors
+			fileErrs, ok := err.(mappingErrors)
+			if !ok {
+				fileErrs = mappingErrors{err}
+			}
+			for _, err := range fileErrs {
+				errs = append(errs, fmt.Errorf("%s: %s", filepath.Base(file), err))
+			}
+			continue
+		}
+		for i := range parsed {
+			if fragments {
+				parsed[i].file = filepath.Base(file)
+			}
+		}
+		mappings = append(mappings, parsed...)
+	}
+	if len(errs) != 0 {
+		return errs
+	}
+
+	m.setConfig(m.newSnapshot(mappings, hash))
+	return nil
 }
 
-func (m *tubeMapper) getMapping(originalTube string) (labels prometheus.Labels, present bool) {
-	m.mutex.Lock()
-	defer m.mutex.Unlock()
+// reload loads the mapping config file, keeping the current config if it's
+// invalid, and records the outcome in the reload metrics.
+func (m *tubeMapper) reload(fileName string) error {
+	err := m.initFromFile(fileName)
+	m.lastReloadMetric.Set(float64(time.Now().UnixNano()) / 1e9)
+	if err != nil {
+		m.configLoadsMetric.WithLabelValues("failure").Inc()
+		m.lastReloadSuccessMetric.Set(0)
+		return err
+	}
+	m.configLoadsMetric.WithLabelValues("success").Inc()
+	m.lastReloadSuccessMetric.Set(1)
+	return nil
+}
 
-	for _, mapping := range m.mappings {
-		matches := mapping.regex.FindStringSubmatchIndex(originalTube)
-		if len(matches) == 0 {
-			continue
+func isYAMLFile(fileName string) bool {
+	ext := filepath.Ext(fileName)
+	return ext == ".yml" || ext == ".yaml"
+}
+
+// convertMappings returns the mapping config in the YAML format.
+func convertMappings(mappings []tubeMapping) ([]byte, error) {
+	config := yamlMappingConfig{Mappings: []yamlMapping{}}
+	for _, mapping := range mappings {
+		rule := yamlMapping{Match: mapping.match, Labels: mapping.labels}
+		if mapping.drop {
+			rule.Action = "drop"
 		}
+		config.Mappings = append(config.Mappings, rule)
+	}
+	return yaml.Marshal(config)
+}
 
-		labels := prometheus.Labels{}
-		for label, valueExpr := range mapping.labels {
-			value := mapping.regex.ExpandString([]byte{}, valueExpr, originalTube, matches)
-			labels[label] = string(value)
+// getMapping returns the labels of a tube, given by the first matching
+// mapping. Dropped tubes have no labels, see dropped.
+func (c *mappingSnapshot) getMapping(originalTube string) (labels prometheus.Labels, present bool) {
+	result := c.lookup(originalTube)
+	if result.mapping == nil || result.mapping.drop {
+		return nil, false
+	}
+	return result.labels, true
+}
+
+// dropped reports whether the first mapping matching the tube drops it.
+func (c *mappingSnapshot) dropped(originalTube string) bool {
+	result := c.lookup(originalTube)
+	return result.mapping != nil && result.mapping.drop
+}
+
+// lookup returns the first mapping matching the tube and the labels it sets.
+// The mapping is nil if none matches. The results are cached when enabled, the
+// cache is emptied once it's full.
+func (c *mappingSnapshot) lookup(originalTube string) mappingResult {
+	if c.cache == nil {
+		return c.match(originalTube)
+	}
+
+	c.cacheMutex.RLock()
+	result, ok := c.cache[originalTube]
+	c.cacheMutex.RUnlock()
+	if ok {
+		return result
+	}
+
+	result = c.match(originalTube)
+	c.cacheMutex.Lock()
+	if len(c.cache) >= c.cacheSize {
+		c.cache = map[string]mappingResult{}
+	}
+	c.cache[originalTube] = result
+	c.cacheMutex.Unlock()
+	return result
+}
+
+// match tries the mappings in order, only the candidates of the index when
+// enabled.
+func (c *mappingSnapshot) match(originalTube string) mappingResult {
+	if c.index == nil {
+		for i := range c.mappings {
+			if result, ok := c.matchMapping(i, originalTube); ok {
+				return result
+			}
 		}
-		return labels, true
+		return mappingResult{}
 	}
 
-	return nil, false
+	for _, i := range c.index.candidates(originalTube) {
+		if result, ok := c.matchMapping(i, originalTube); ok {
+			return result
+		}
+	}
+	return mappingResult{}
+}
+
+func (c *mappingSnapshot) matchMapping(i int, originalTube string) (mappingResult, bool) {
+	mapping := &c.mappings[i]
+	matches := mapping.regex.FindStringSubmatchIndex(originalTube)
+	if len(matches) == 0 {
+		return mappingResult{}, false
+	}
+	if mapping.drop {
+		return mappingResult{mapping: mapping}, true
+	}
+	return mappingResult{mapping: mapping, labels: mapping.expand(originalTube, matches)}, true
+}
+
+// expand returns the labels set by the mapping on the tube, given the indexes
+// of the submatches of its regex.
+func (mapping *tubeMapping) expand(originalTube string, matches []int) prometheus.Labels {
+	labels := prometheus.Labels{}
+	for label, valueExpr := range mapping.labels {
+		value := mapping.regex.ExpandString([]byte{}, valueExpr, originalTube, matches)
+		labels[label] = string(value)
+	}
+	return labels
+}
+
+func (m *tubeMapper) setAggregate(aggregate bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.aggregate = aggregate
+}
+
+func (m *tubeMapper) aggregating() bool {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	return m.aggregate
+}
+
+// setCacheSize sets the maximum number of tubes whose mapping is cached, 0
+// disables the cache. It applies to the configs loaded afterwards.
+func (m *tubeMapper) setCacheSize(size int) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.cacheSize = size
 }
 
-func (m *tubeMapper) getAllLabels() []string {
+// setPrefixIndex sets whether the mappings are indexed by the literal prefix
+// of their regex. It applies to the configs loaded afterwards.
+func (m *tubeMapper) setPrefixIndex(enabled bool) {
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
 
-	return m.allLabels
+	m.usePrefixIndex = enabled
 }
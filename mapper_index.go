@@ -0,0 +1,43 @@
+package main
+
+import (
+	"sort"
+)
+
+// prefixIndex indexes mappings by the literal prefix of their regex, so that
+// only the mappings whose prefix starts the tube name are tried.
+type prefixIndex struct {
+	// the distinct prefix lengths, in increasing order
+	lengths []int
+	// the indexes of the mappings by prefix
+	mappings map[string][]int
+}
+
+func newPrefixIndex(mappings []tubeMapping) *prefixIndex {
+	index := &prefixIndex{mappings: map[string][]int{}}
+	lengths := map[int]bool{}
+	for i, mapping := range mappings {
+		prefix, _ := mapping.regex.LiteralPrefix()
+		index.mappings[prefix] = append(index.mappings[prefix], i)
+		if !lengths[len(prefix)] {
+			lengths[len(prefix)] = true
+			index.lengths = append(index.lengths, len(prefix))
+		}
+	}
+	sort.Ints(index.lengths)
+	return index
+}
+
+// candidates returns the indexes of the mappings which may match the tube, in
+// the order of the config.
+func (index *prefixIndex) candidates(originalTube string) []int {
+	var candidates []int
+	for _, length := range index.lengths {
+		if length > len(originalTube) {
+			break
+		}
+		candidates = append(candidates, index.mappings[originalTube[:length]]...)
+	}
+	sort.Ints(candidates)
+	return candidates
+}
@@ -13,13 +13,25 @@
 
 package main
 
-import "testing"
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
 
 func TestMetricMapper(t *testing.T) {
 	scenarios := []struct {
 		config    string
 		configBad bool
 		mappings  map[string]map[string]string
+		dropped   []string
 	}{
 		// Empty config.
 		{},
@@ -79,6 +91,43 @@ func TestMetricMapper(t *testing.T) {
 				},
 			},
 		},
+		// Config dropping tubes.
+		{
+			config: `
+				tmp-.*
+				drop
+
+				test.(\w*)
+				name="name"
+			`,
+			mappings: map[string]map[string]string{
+				"tmp-1":  map[string]string{},
+				"test.a": map[string]string{"name": "name"},
+			},
+			dropped: []string{"tmp-1"},
+		},
+		// Config with an alternation, anchored on all its alternatives.
+		{
+			config: `
+				tmp-.*|debug-.*
+				name="scratch"
+			`,
+			mappings: map[string]map[string]string{
+				"tmp-1":            map[string]string{"name": "scratch"},
+				"debug-2":          map[string]string{"name": "scratch"},
+				"my-debug-1":       map[string]string{},
+				"prod-debug-queue": map[string]string{},
+			},
+		},
+		// Config dropping tubes and setting labels.
+		{
+			config: `
+				tmp-.*
+				drop
+				name="tmp"
+			`,
+			configBad: true,
+		},
 		// Config with bad label line.
 		{
 			config: `
@@ -103,6 +152,35 @@ func TestMetricMapper(t *testing.T) {
 			`,
 			configBad: true,
 		},
+		// Config with a one character label name.
+		{
+			config: `
+				test.(\d*)
+				name="test"
+				a="$1"
+			`,
+			mappings: map[string]map[string]string{
+				"test.1": map[string]string{"name": "test", "a": "1"},
+			},
+		},
+		// Config with an invalid label name.
+		{
+			config: `
+				test.(\d*)
+				name="test"
+				job-id="$1"
+			`,
+			configBad: true,
+		},
+		// Config with a label name reserved by Prometheus.
+		{
+			config: `
+				test.(\d*)
+				name="test"
+				__user="$1"
+			`,
+			configBad: true,
+		},
 	}
 
 	mapper := newTubeMapper()
@@ -116,7 +194,7 @@ func TestMetricMapper(t *testing.T) {
 		}
 
 		for tube, mapping := range scenario.mappings {
-			labels, present := mapper.getMapping(tube)
+			labels, present := mapper.current().getMapping(tube)
 			if len(labels) == 0 && present {
 				t.Fatalf("%d.%q: Expected tube to not be present", i, tube)
 			}
@@ -129,5 +207,609 @@ func TestMetricMapper(t *testing.T) {
 				}
 			}
 		}
+		for _, tube := range scenario.dropped {
+			if !mapper.current().dropped(tube) {
+				t.Fatalf("%d.%q: Expected tube to be dropped", i, tube)
+			}
+		}
+		for tube := range scenario.mappings {
+			if mapper.current().dropped(tube) && !contains(scenario.dropped, tube) {
+				t.Fatalf("%d.%q: Expected tube not to be dropped", i, tube)
+			}
+		}
+	}
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func TestYAMLMapper(t *testing.T) {
+	scenarios := []struct {
+		config    string
+		configBad bool
+		mappings  map[string]map[string]string
+	}{
+		// Empty config.
+		{},
+		// Config with several rules, the first matching one is applied.
+		{
+			config: `
+mappings:
+  # per user tubes
+  - match: some-tube-(\d*)-(\w*)
+    labels:
+      name: some-tube
+      identifier: $1
+      action: $2
+  - match: some-tube-(.*)
+    labels:
+      name: other-tube
+`,
+			mappings: map[string]map[string]string{
+				"some-tube-773-open": {
+					"name":       "some-tube",
+					"identifier": "773",
+					"action":     "open",
+				},
+				"some-tube-x.y": {
+					"name": "other-tube",
+				},
+				"unknown": nil,
+			},
+		},
+		// Config dropping tubes.
+		{
+			config: `
+mappings:
+  - match: tmp-.*
+    action: drop
+  - match: .*
+    labels:
+      name: other
+`,
+			mappings: map[string]map[string]string{
+				"tmp-1": nil,
+				"test":  {"name": "other"},
+			},
+		},
+		// Config with an alternation, anchored on all its alternatives.
+		{
+			config: `
+mappings:
+  - match: tmp-(.*)|debug-(.*)
+    labels:
+      name: scratch
+      suffix: $1$2
+`,
+			mappings: map[string]map[string]string{
+				"tmp-1":            {"name": "scratch", "suffix": "1"},
+				"debug-2":          {"name": "scratch", "suffix": "2"},
+				"my-debug-1":       nil,
+				"prod-debug-queue": nil,
+				"tmp-1-prod":       {"name": "scratch", "suffix": "1-prod"},
+			},
+		},
+		// Config with a one character label name.
+		{
+			config: `
+mappings:
+  - match: test-(.*)
+    labels:
+      name: test
+      a: $1
+`,
+			mappings: map[string]map[string]string{
+				"test-1": {"name": "test", "a": "1"},
+			},
+		},
+		// Config with an invalid label name.
+		{
+			config: `
+mappings:
+  - match: test-(.*)
+    labels:
+      name: test
+      job-id: $1
+`,
+			configBad: true,
+		},
+		// Config with a label name reserved by Prometheus.
+		{
+			config: `
+mappings:
+  - match: test-(.*)
+    labels:
+      name: test
+      __user: $1
+`,
+			configBad: true,
+		},
+		// Config dropping tubes and setting labels.
+		{
+			config: `
+mappings:
+  - match: tmp-.*
+    action: drop
+    labels:
+      name: tmp
+`,
+			configBad: true,
+		},
+		// Config with an unknown action.
+		{
+			config: `
+mappings:
+  - match: tmp-.*
+    action: keep
+`,
+			configBad: true,
+		},
+		// Config with a bad regex.
+		{
+			config: `
+mappings:
+  - match: some-tube-(
+    labels:
+      name: some-tube
+`,
+			configBad: true,
+		},
+		// Config without tube name.
+		{
+			config: `
+mappings:
+  - match: some-tube
+    labels:
+      job: some-tube
+`,
+			configBad: true,
+		},
+		// Config with bad tube name.
+		{
+			config: `
+mappings:
+  - match: some-tube
+    labels:
+      name: 0foo
+`,
+			configBad: true,
+		},
+		// Config with an unknown field.
+		{
+			config: `
+mappings:
+  - match: some-tube
+    lables:
+      name: some-tube
+`,
+			configBad: true,
+		},
+	}
+
+	mapper := newTubeMapper()
+	for i, scenario := range scenarios {
+		err := mapper.initFromYAML(scenario.config)
+		if err != nil && !scenario.configBad {
+			t.Fatalf("%d. Config load error: %s", i, err)
+		}
+		if err == nil && scenario.configBad {
+			t.Fatalf("%d. Expected bad config, but loaded ok", i)
+		}
+
+		for tube, mapping := range scenario.mappings {
+			labels, present := mapper.current().getMapping(tube)
+			if present != (mapping != nil) {
+				t.Fatalf("%d.%q: Expected present to be %v", i, tube, mapping != nil)
+			}
+			if len(labels) != len(mapping) {
+				t.Fatalf("%d.%q: Expected %d labels, got %d", i, tube, len(mapping), len(labels))
+			}
+			for label, value := range labels {
+				if mapping[label] != value {
+					t.Fatalf("%d.%q: Expected labels %v, got %v", i, tube, mapping, labels)
+				}
+			}
+		}
+	}
+}
+
+func TestConvertMappings(t *testing.T) {
+	legacy := `
+		incoming-emails-(\d+)
+		name="incoming-emails"
+		user_id="$1"
+
+		some-other-tube-(\w+)-processor-(\d+)
+		name="some-other-tube"
+		processor="$1"
+		node_id="$2"
+
+		tmp-.*
+		drop
+	`
+	mappings, err := parseMappings(legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	converted, err := convertMappings(mappings)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	legacyMapper := newTubeMapper()
+	if err := legacyMapper.initFromString(legacy); err != nil {
+		t.Fatal(err)
+	}
+	yamlMapper := newTubeMapper()
+	if err := yamlMapper.initFromYAML(string(converted)); err != nil {
+		t.Fatalf("Converted config load error: %s\n%s", err, converted)
+	}
+
+	for _, tube := range []string{"incoming-emails-42", "some-other-tube-resize-processor-3", "tmp-1", "default"} {
+		if yamlMapper.current().dropped(tube) != legacyMapper.current().dropped(tube) {
+			t.Fatalf("%q: Expected dropped to be %v", tube, legacyMapper.current().dropped(tube))
+		}
+		expected, expectedPresent := legacyMapper.current().getMapping(tube)
+		labels, present := yamlMapper.current().getMapping(tube)
+		if present != expectedPresent || !reflect.DeepEqual(labels, expected) {
+			t.Fatalf("%q: Expected %v, got %v", tube, expected, labels)
+		}
+	}
+}
+
+func TestMapperErrors(t *testing.T) {
+	config := `incoming-(\d+
+name="incoming"
+
+valid-(\d+)
+name="valid"
+
+bad-label
+name=bad
+
+no-labels
+
+no-name
+job="foo"`
+	expected := []string{
+		"Line 1: invalid tube regex: error parsing regexp: missing closing ): `incoming-(\\d+`",
+		"Line 8: expected label mapping line, got: name=bad",
+		"Line 10: tube mapping didn't set any labels",
+		"Line 12: tube mapping didn't set a tube name",
+	}
+
+	_, err := parseMappings(config)
+	errs, ok := err.(mappingErrors)
+	if !ok {
+		t.Fatalf("Expected mapping errors, got %v", err)
+	}
+	if len(errs) != len(expected) {
+		t.Fatalf("Expected %d errors, got %v", len(expected), errs)
+	}
+	for i, err := range errs {
+		if err.Error() != expected[i] {
+			t.Fatalf("%d. Expected %q, got %q", i, expected[i], err)
+		}
+	}
+}
+
+func TestMapperReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "beanstalkd_exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fileName := filepath.Join(dir, "mapping.conf")
+
+	value := func(m prometheus.Metric) float64 {
+		var metric dto.Metric
+		if err := m.Write(&metric); err != nil {
+			t.Fatal(err)
+		}
+		if metric.Gauge != nil {
+			return metric.GetGauge().GetValue()
+		}
+		return metric.GetCounter().GetValue()
+	}
+
+	scenarios := []struct {
+		config    string
+		configBad bool
+		tubeName  string
+	}{
+		{
+			config:   "emails-(\\d+)\nname=\"emails\"\n",
+			tubeName: "emails",
+		},
+		// The previous config is kept.
+		{
+			config:    "emails-(\\d+\nname=\"other\"\n",
+			configBad: true,
+			tubeName:  "emails",
+		},
+		{
+			config:   "emails-(\\d+)\nname=\"other\"\n",
+			tubeName: "other",
+		},
+	}
+
+	mapper := newTubeMapper()
+	// without any config to load, the empty one is successfully loaded
+	if got := value(mapper.lastReloadSuccessMetric); got != 1 {
+		t.Fatalf("Expected last reload success to be 1 before any reload, got %v", got)
+	}
+
+	var hashes []float64
+	for i, scenario := range scenarios {
+		if err := ioutil.WriteFile(fileName, []byte(scenario.config), 0644); err != nil {
+			t.Fatal(err)
+		}
+		before := time.Now().Unix()
+		err := mapper.reload(fileName)
+		if err != nil && !scenario.configBad {
+			t.Fatalf("%d. Config load error: %s", i, err)
+		}
+		if err == nil && scenario.configBad {
+			t.Fatalf("%d. Expected bad config, but loaded ok", i)
+		}
+
+		labels, present := mapper.current().getMapping("emails-42")
+		if !present || labels["name"] != scenario.tubeName {
+			t.Fatalf("%d. Expected tube name %s, got %v", i, scenario.tubeName, labels)
+		}
+
+		success := 1.0
+		if scenario.configBad {
+			success = 0
+		}
+		if got := value(mapper.lastReloadSuccessMetric); got != success {
+			t.Fatalf("%d. Expected last reload success to be %v, got %v", i, success, got)
+		}
+		if got := value(mapper.configLoadsMetric.WithLabelValues("failure")); got != 1 && i > 0 {
+			t.Fatalf("%d. Expected a single failed reload, got %v", i, got)
+		}
+		if got := value(mapper.lastReloadMetric); got < float64(before) {
+			t.Fatalf("%d. Expected a last reload time after %v, got %v", i, before, got)
+		}
+		hashes = append(hashes, value(mapper.configHashMetric))
+
+		// the exported hash is the one the watcher compares
+		hash, err := hashConfigFiles(fileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !scenario.configBad && hashes[i] != hashValue(hash) {
+			t.Fatalf("%d. Expected the hash %v of the watched files, got %v", i, hashValue(hash), hashes[i])
+		}
+	}
+
+	if hashes[0] == 0 || hashes[1] != hashes[0] || hashes[2] == hashes[0] {
+		t.Fatalf("Expected the hash to change with the active config only, got %v", hashes)
+	}
+}
+
+func TestMapperDirectory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "beanstalkd_exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fragments := map[string]string{
+		"20-emails.conf": "emails-.*\nname=\"other\"\n",
+		"10-emails.yml":  "mappings:\n- match: emails-(\\d+)\n  labels:\n    name: emails\n",
+		".hidden.conf":   "invalid",
+	}
+	for name, contents := range fragments {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mapper := newTubeMapper()
+	if err := mapper.initFromFile(dir); err != nil {
+		t.Fatalf("Config load error: %s", err)
+	}
+	// the first file wins
+	if labels, _ := mapper.current().getMapping("emails-42"); labels["name"] != "emails" {
+		t.Fatalf("Expected tube name emails, got %v", labels)
+	}
+	if labels, _ := mapper.current().getMapping("emails-x"); labels["name"] != "other" {
+		t.Fatalf("Expected tube name other, got %v", labels)
+	}
+
+	// an invalid fragment rejects the whole config
+	err = ioutil.WriteFile(filepath.Join(dir, "30-invalid.conf"), []byte("invalid\nname=invalid\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = mapper.initFromFile(dir)
+	expected := "30-invalid.conf: Line 2: expected label mapping line, got: name=invalid"
+	if err == nil || err.Error() != expected {
+		t.Fatalf("Expected error %q, got %v", expected, err)
+	}
+	if labels, _ := mapper.current().getMapping("emails-42"); labels["name"] != "emails" {
+		t.Fatalf("Expected the previous config to be kept, got %v", labels)
+	}
+}
+
+func TestMapperCacheAndIndex(t *testing.T) {
+	config := `
+		emails-(\d+)
+		name="emails"
+		user_id="$1"
+
+		emails-tmp-.*
+		drop
+
+		(?i)EMAILS-.*
+		name="upper"
+
+		em.*-(\w+)
+		name="em"
+		kind="$1"
+
+		.*
+		name="other"
+	`
+	tubes := []string{"emails-42", "emails-tmp-1", "EMAILS-x", "emails-x", "emergency-y", "e", "", "default"}
+
+	expected := map[string]prometheus.Labels{}
+	reference := newTubeMapper()
+	if err := reference.initFromString(config); err != nil {
+		t.Fatal(err)
+	}
+	for _, tube := range tubes {
+		expected[tube], _ = reference.current().getMapping(tube)
+	}
+
+	scenarios := []struct {
+		cacheSize   int
+		prefixIndex bool
+	}{
+		{cacheSize: 0, prefixIndex: true},
+		{cacheSize: 100, prefixIndex: false},
+		{cacheSize: 3, prefixIndex: true},
+	}
+
+	for i, scenario := range scenarios {
+		mapper := newTubeMapper()
+		mapper.setCacheSize(scenario.cacheSize)
+		mapper.setPrefixIndex(scenario.prefixIndex)
+		if err := mapper.initFromString(config); err != nil {
+			t.Fatal(err)
+		}
+
+		// twice, to get the cached results
+		for j := 0; j < 2; j++ {
+			for _, tube := range tubes {
+				labels, _ := mapper.current().getMapping(tube)
+				if !reflect.DeepEqual(labels, expected[tube]) {
+					t.Fatalf("%d.%q: Expected labels %v, got %v", i, tube, expected[tube], labels)
+				}
+				if mapper.current().dropped(tube) != reference.current().dropped(tube) {
+					t.Fatalf("%d.%q: Expected dropped to be %v", i, tube, reference.current().dropped(tube))
+				}
+			}
+		}
+		if scenario.cacheSize > 0 && len(mapper.current().cache) > scenario.cacheSize {
+			t.Fatalf("%d. Expected at most %d cached tubes, got %d", i, scenario.cacheSize, len(mapper.current().cache))
+		}
+
+		// a reload invalidates the cache
+		if err := mapper.initFromString("emails-(\\d+)\nname=\"reloaded\"\n"); err != nil {
+			t.Fatal(err)
+		}
+		if labels, _ := mapper.current().getMapping("emails-42"); labels["name"] != "reloaded" {
+			t.Fatalf("%d. Expected the reloaded mapping, got %v", i, labels)
+		}
+	}
+}
+
+// benchmarkConfig returns a config of n rules and n*ratio tube names, most of
+// them matching one of the last rules.
+func benchmarkConfig(n, ratio int) (string, []string) {
+	var config string
+	var tubes []string
+	for i := 0; i < n; i++ {
+		config += fmt.Sprintf("service-%d-queue-(\\d+)\nname=\"service-%d\"\nshard=\"$1\"\n\n", i, i)
+		for j := 0; j < ratio; j++ {
+			tubes = append(tubes, fmt.Sprintf("service-%d-queue-%d", n-1-i%(n/10+1), j))
+		}
+	}
+	return config, tubes
+}
+
+func BenchmarkGetMapping(b *testing.B) {
+	config, tubes := benchmarkConfig(300, 33)
+
+	scenarios := []struct {
+		name        string
+		cacheSize   int
+		prefixIndex bool
+	}{
+		{name: "plain"},
+		{name: "prefix-index", prefixIndex: true},
+		{name: "cache", cacheSize: 100000},
+		{name: "cache-prefix-index", cacheSize: 100000, prefixIndex: true},
+	}
+
+	for _, scenario := range scenarios {
+		b.Run(scenario.name, func(b *testing.B) {
+			mapper := newTubeMapper()
+			mapper.setCacheSize(scenario.cacheSize)
+			mapper.setPrefixIndex(scenario.prefixIndex)
+			if err := mapper.initFromString(config); err != nil {
+				b.Fatal(err)
+			}
+
+			mappings := mapper.current()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				mappings.getMapping(tubes[i%len(tubes)])
+			}
+		})
+	}
+}
+
+func BenchmarkGetMappingParallel(b *testing.B) {
+	config, tubes := benchmarkConfig(300, 33)
+	mapper := newTubeMapper()
+	mapper.setCacheSize(100000)
+	if err := mapper.initFromString(config); err != nil {
+		b.Fatal(err)
+	}
+
+	mappings := mapper.current()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			mappings.getMapping(tubes[i%len(tubes)])
+			i++
+		}
+	})
+}
+
+func TestPrefixIndex(t *testing.T) {
+	mappings, err := parseMappings(`
+		emails-(\d+)
+		name="emails"
+
+		emails-tmp-.*
+		drop
+
+		(?i)EMAILS-.*
+		name="upper"
+
+		emails-(\w+)
+		name="other"
+
+		sms-.*
+		name="sms"
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index := newPrefixIndex(mappings)
+
+	scenarios := []struct {
+		tube       string
+		candidates []int
+	}{
+		{tube: "emails-42", candidates: []int{0, 2, 3}},
+		{tube: "emails-tmp-1", candidates: []int{0, 1, 2, 3}},
+		{tube: "sms-1", candidates: []int{2, 4}},
+		{tube: "e", candidates: []int{2}},
+	}
+	for i, scenario := range scenarios {
+		if candidates := index.candidates(scenario.tube); !reflect.DeepEqual(candidates, scenario.candidates) {
+			t.Fatalf("%d.%q: Expected candidates %v, got %v", i, scenario.tube, scenario.candidates, candidates)
+		}
 	}
 }
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// convertMappingCommand prints the legacy mapping config file given in the
+// arguments in the YAML format.
+func convertMappingCommand(args []string, out io.Writer) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: beanstalkd_exporter convert-mapping <file>")
+	}
+
+	contents, err := ioutil.ReadFile(args[0])
+	if err != nil {
+		return err
+	}
+	mappings, err := parseMappings(string(contents))
+	if err != nil {
+		return fmt.Errorf("%s: %s", args[0], err)
+	}
+	converted, err := convertMappings(mappings)
+	if err != nil {
+		return err
+	}
+	_, err = out.Write(converted)
+	return err
+}
+
+// checkMappingCommand loads the mapping config file given in the arguments and
+// reports all its errors. For every following tube name, it prints the
+// matching mapping and the resulting labels.
+func checkMappingCommand(args []string, out io.Writer) error {
+	if len(args) < 1 {
+		return fmt.Errorf("usage: beanstalkd_exporter check-mapping <file> [tube names...]")
+	}
+	fileName := args[0]
+
+	m := newTubeMapper()
+	if err := m.initFromFile(fileName); err != nil {
+		errs, ok := err.(mappingErrors)
+		if !ok {
+			errs = mappingErrors{err}
+		}
+		for _, err := range errs {
+			fmt.Fprintf(out, "%s: %s\n", fileName, err)
+		}
+		return fmt.Errorf("%s: invalid mapping config", fileName)
+	}
+	mappings := m.current()
+	fmt.Fprintf(out, "%s: %d mappings loaded\n", fileName, len(mappings.mappings))
+
+	for _, tube := range args[1:] {
+		result := mappings.lookup(tube)
+		switch {
+		case result.mapping == nil:
+			fmt.Fprintf(out, "%s: no matching mapping, %s\n", tube, formatLabels(prometheus.Labels{"tube": tube}))
+		case result.mapping.drop:
+			fmt.Fprintf(out, "%s: dropped by %s\n", tube, describeMapping(result.mapping))
+		default:
+			labels := prometheus.Labels{"tube": result.labels["name"]}
+			for label, value := range result.labels {
+				if label != "name" {
+					labels[label] = value
+				}
+			}
+			fmt.Fprintf(out, "%s: matched %s, %s\n", tube, describeMapping(result.mapping), formatLabels(labels))
+		}
+	}
+	return nil
+}
+
+// describeMapping returns the regex of the mapping and its file and line, if
+// known.
+func describeMapping(mapping *tubeMapping) string {
+	switch {
+	case mapping.line == 0 && mapping.file == "":
+		return mapping.match
+	case mapping.line == 0:
+		return fmt.Sprintf("%s (%s)", mapping.match, mapping.file)
+	case mapping.file == "":
+		return fmt.Sprintf("%s (line %d)", mapping.match, mapping.line)
+	default:
+		return fmt.Sprintf("%s (%s, line %d)", mapping.match, mapping.file, mapping.line)
+	}
+}
+
+func formatLabels(labels prometheus.Labels) string {
+	names, values := sortedLabels(labels)
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = fmt.Sprintf("%s=%q", name, values[i])
+	}
+	return "{" + strings.Join(pairs, ", ") + "}"
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckMappingCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "beanstalkd_exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	scenarios := []struct {
+		fileName string
+		contents string
+		tubes    []string
+		bad      bool
+		output   []string
+	}{
+		{
+			fileName: "mapping.conf",
+			contents: "emails-(\\d+)\nname=\"emails\"\nuser_id=\"$1\"\n\ntmp-.*\ndrop\n",
+			tubes:    []string{"emails-42", "tmp-1", "default"},
+			output: []string{
+				"mapping.conf: 2 mappings loaded",
+				`emails-42: matched emails-(\d+) (line 1), {tube="emails", user_id="42"}`,
+				"tmp-1: dropped by tmp-.* (line 5)",
+				`default: no matching mapping, {tube="default"}`,
+			},
+		},
+		{
+			fileName: "mapping.yml",
+			contents: "mappings:\n- match: emails-(\\d+)\n  labels:\n    name: emails\n",
+			tubes:    []string{"emails-42"},
+			output: []string{
+				"mapping.yml: 1 mappings loaded",
+				`emails-42: matched emails-(\d+) (line 2), {tube="emails"}`,
+			},
+		},
+		{
+			fileName: "bad.yml",
+			contents: "mappings:\n  # emails\n  - match: emails-(\\d+\n    labels:\n      name: emails\n\n  - match: ok\n    labels:\n      name: ok\n  - match: no-name\n    labels:\n      job: x\n",
+			bad:      true,
+			output: []string{
+				"bad.yml: Line 3: invalid tube regex: error parsing regexp: missing closing ): `emails-(\\d+`",
+				"bad.yml: Line 10: tube mapping didn't set a tube name",
+			},
+		},
+		{
+			fileName: "flow.yml",
+			contents: "mappings: [{match: ok, labels: {name: ok}}, {match: no-name, labels: {job: x}}]\n",
+			bad:      true,
+			output: []string{
+				"flow.yml: Mapping 2 (match 'no-name'): tube mapping didn't set a tube name",
+			},
+		},
+		{
+			fileName: "bad.conf",
+			contents: "emails-(\\d+\nname=\"emails\"\n\nok\nname=\"ok\"\n\nno-name\njob=\"x\"\n",
+			bad:      true,
+			output: []string{
+				"bad.conf: Line 1: invalid tube regex: error parsing regexp: missing closing ): `emails-(\\d+`",
+				"bad.conf: Line 7: tube mapping didn't set a tube name",
+			},
+		},
+	}
+
+	for i, scenario := range scenarios {
+		fileName := filepath.Join(dir, scenario.fileName)
+		if err := ioutil.WriteFile(fileName, []byte(scenario.contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		var out bytes.Buffer
+		err := checkMappingCommand(append([]string{fileName}, scenario.tubes...), &out)
+		if err != nil && !scenario.bad {
+			t.Fatalf("%d. unexpected error: %s", i, err)
+		}
+		if err == nil && scenario.bad {
+			t.Fatalf("%d. Expected an error", i)
+		}
+
+		expected := strings.Join(scenario.output, "\n") + "\n"
+		if got := strings.Replace(out.String(), dir+string(filepath.Separator), "", -1); got != expected {
+			t.Fatalf("%d. Expected output:\n%s\ngot:\n%s", i, expected, got)
+		}
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// probeHandler scrapes the beanstalkd server given in the target parameter
+// once and returns its metrics.
+func probeHandler(w http.ResponseWriter, r *http.Request) {
+	target := r.URL.Query().Get("target")
+	if target == "" {
+		http.Error(w, "Target parameter is missing", http.StatusBadRequest)
+		return
+	}
+
+	exporter := newExporterFromFlags(target)
+	defer exporter.Close()
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(deadlineCollector{exporter, scrapeDeadline(r)})
+
+	promhttp.HandlerFor(
+		registry,
+		promhttp.HandlerOpts{ErrorHandling: promhttp.ContinueOnError},
+	).ServeHTTP(w, r)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProbeHandler(t *testing.T) {
+	mapper = newTubeMapper()
+
+	server := newFakeBeanstalkd(t,
+		map[string]string{"current-jobs-ready": "7"},
+		map[string]map[string]string{
+			"a":       {"current-jobs-ready": "1"},
+			"b":       {"current-jobs-ready": "2"},
+			"default": {"current-jobs-ready": "7"},
+		},
+	)
+	defer server.close()
+
+	rr := httptest.NewRecorder()
+	probeHandler(rr, httptest.NewRequest("GET", "/probe?target="+server.addr(), nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, rr.Code)
+	}
+	body, _ := ioutil.ReadAll(rr.Body)
+	expected := `current_jobs_ready{instance="` + server.addr() + `"} 7`
+	if !strings.Contains(string(body), expected) {
+		t.Fatalf("Expected %q in probe output, got:\n%s", expected, body)
+	}
+
+	// with the default offset, the deadline is 450ms away: a is fetched, b
+	// times out and default is skipped, which the probe output accounts for
+	server.setTubeDelay(300 * time.Millisecond)
+	r := httptest.NewRequest("GET", "/probe?target="+server.addr(), nil)
+	r.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", "0.95")
+	rr = httptest.NewRecorder()
+	probeHandler(rr, r)
+	body, _ = ioutil.ReadAll(rr.Body)
+	expected = `beanstalkd_exporter_tubes_skipped_total{instance="` + server.addr() + `"} 1`
+	if !strings.Contains(string(body), expected) {
+		t.Fatalf("Expected %q in probe output, got:\n%s", expected, body)
+	}
+
+	rr = httptest.NewRecorder()
+	probeHandler(rr, httptest.NewRequest("GET", "/probe", nil))
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("Expected status %d without target, got %d", http.StatusBadRequest, rr.Code)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/prometheus/common/log"
+)
+
+// reloadMutex serializes the reloads triggered by the file watcher, SIGHUP and
+// the reload endpoint.
+var reloadMutex sync.Mutex
+
+// reloadMapping reloads the mapping config file, if any, keeping the previous
+// config on error. It's the single reload path of all the reload triggers.
+func reloadMapping(fileName string, mapper *tubeMapper) error {
+	if fileName == "" {
+		log.Debug("No mapping config to reload")
+		return nil
+	}
+
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+
+	err := mapper.reload(fileName)
+	if err != nil {
+		log.Errorf("Error reloading config, keeping the previous one: %v", err)
+	} else {
+		log.Warn("Config reloaded successfully")
+	}
+	return err
+}
+
+// reloadOnSIGHUP reloads the mapping config file in the background every time
+// the process receives SIGHUP. SIGHUP is handled once it returns.
+func reloadOnSIGHUP(fileName string, mapper *tubeMapper) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			log.Warn("Received SIGHUP, attempting reload")
+			reloadMapping(fileName, mapper)
+		}
+	}()
+}
+
+// reloadHandler reloads the mapping config file on POST requests. Without
+// mapping config, there's nothing to reload and the request fails.
+func reloadHandler(fileName string, mapper *tubeMapper) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "Only POST requests are allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if fileName == "" {
+			http.Error(w, "No mapping config to reload, see -mapping-config", http.StatusBadRequest)
+			return
+		}
+		if err := reloadMapping(fileName, mapper); err != nil {
+			http.Error(w, "Error reloading config: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte("Config reloaded\n"))
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestReloadHandler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "beanstalkd_exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fileName := filepath.Join(dir, "mapping.conf")
+
+	mapper := newTubeMapper()
+	handler := reloadHandler(fileName, mapper)
+
+	scenarios := []struct {
+		method   string
+		config   string
+		status   int
+		tubeName string
+	}{
+		{
+			method:   "POST",
+			config:   "emails-(\\d+)\nname=\"emails\"\n",
+			status:   http.StatusOK,
+			tubeName: "emails",
+		},
+		{
+			method:   "GET",
+			config:   "emails-(\\d+)\nname=\"other\"\n",
+			status:   http.StatusMethodNotAllowed,
+			tubeName: "emails",
+		},
+		// The previous config is kept.
+		{
+			method:   "POST",
+			config:   "emails-(\\d+\nname=\"other\"\n",
+			status:   http.StatusInternalServerError,
+			tubeName: "emails",
+		},
+		{
+			method:   "POST",
+			config:   "emails-(\\d+)\nname=\"other\"\n",
+			status:   http.StatusOK,
+			tubeName: "other",
+		},
+	}
+
+	for i, scenario := range scenarios {
+		if err := ioutil.WriteFile(fileName, []byte(scenario.config), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest(scenario.method, "/-/reload", nil))
+		if w.Code != scenario.status {
+			t.Fatalf("%d. Expected status %d, got %d: %s", i, scenario.status, w.Code, w.Body)
+		}
+
+		labels, _ := mapper.current().getMapping("emails-42")
+		if labels["name"] != scenario.tubeName {
+			t.Fatalf("%d. Expected tube name %s, got %v", i, scenario.tubeName, labels)
+		}
+	}
+
+	var metric dto.Metric
+	if err := mapper.configLoadsMetric.WithLabelValues("success").Write(&metric); err != nil {
+		t.Fatal(err)
+	}
+	if got := metric.GetCounter().GetValue(); got != 2 {
+		t.Fatalf("Expected 2 successful reloads, got %v", got)
+	}
+
+	// Without mapping config, nothing is reloaded.
+	w := httptest.NewRecorder()
+	reloadHandler("", mapper)(w, httptest.NewRequest("POST", "/-/reload", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("Expected status %d without mapping config, got %d: %s", http.StatusBadRequest, w.Code, w.Body)
+	}
+}
+
+func TestReloadOnSIGHUP(t *testing.T) {
+	dir, err := ioutil.TempDir("", "beanstalkd_exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fileName := filepath.Join(dir, "mapping.conf")
+	if err := ioutil.WriteFile(fileName, []byte("emails-(\\d+)\nname=\"emails\"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	mapper := newTubeMapper()
+	reloadOnSIGHUP(fileName, mapper)
+	if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+
+	reloads := func() float64 {
+		var metric dto.Metric
+		if err := mapper.configLoadsMetric.WithLabelValues("success").Write(&metric); err != nil {
+			t.Fatal(err)
+		}
+		return metric.GetCounter().GetValue()
+	}
+	for start := time.Now(); reloads() == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("Expected a reload on SIGHUP")
+		}
+	}
+
+	labels, _ := mapper.current().getMapping("emails-42")
+	if labels["name"] != "emails" {
+		t.Fatalf("Expected tube name emails, got %v", labels)
+	}
+}
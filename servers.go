@@ -0,0 +1,28 @@
+package main
+
+import (
+	"io/ioutil"
+	"strings"
+)
+
+// parseServers parses a servers config: one beanstalkd address per line.
+// Empty lines and lines starting with '#' are ignored.
+func parseServers(fileContents string) []string {
+	var servers []string
+	for _, line := range strings.Split(fileContents, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		servers = append(servers, line)
+	}
+	return servers
+}
+
+func readServersFromFile(fileName string) ([]string, error) {
+	serversStr, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	return parseServers(string(serversStr)), nil
+}
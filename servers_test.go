@@ -0,0 +1,21 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseServers(t *testing.T) {
+	config := `
+		# production
+		beanstalkd-1:11300
+		  beanstalkd-2:11300
+
+		# staging
+		beanstalkd-staging:11300
+	`
+	expected := []string{"beanstalkd-1:11300", "beanstalkd-2:11300", "beanstalkd-staging:11300"}
+	if servers := parseServers(config); !reflect.DeepEqual(servers, expected) {
+		t.Fatalf("Expected %v, got %v", expected, servers)
+	}
+}
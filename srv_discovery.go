@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+)
+
+// srvSource is the discovery source of the servers found in DNS SRV records.
+const srvSource = "srv"
+
+// srvResolver is implemented by net.Resolver.
+type srvResolver interface {
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+}
+
+// srvDiscovery periodically resolves a DNS SRV record into the list of
+// beanstalkd servers to scrape.
+type srvDiscovery struct {
+	name     string
+	interval time.Duration
+	resolver srvResolver
+	update   func(targets []target)
+
+	lookupFailuresMetric prometheus.Counter
+}
+
+func newSRVDiscovery(name string, interval time.Duration, resolver srvResolver, update func(targets []target)) *srvDiscovery {
+	return &srvDiscovery{
+		name:     name,
+		interval: interval,
+		resolver: resolver,
+		update:   update,
+		lookupFailuresMetric: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Namespace: "beanstalkd",
+				Subsystem: "exporter",
+				Name:      "srv_lookup_failures_total",
+				Help:      "The number of failed DNS SRV lookups.",
+			},
+		),
+	}
+}
+
+// run refreshes the servers every interval, it never returns.
+func (d *srvDiscovery) run() {
+	d.refresh()
+	for range time.Tick(d.interval) {
+		d.refresh()
+	}
+}
+
+// refresh resolves the SRV record and updates the servers. On failure the
+// previously found servers are kept.
+func (d *srvDiscovery) refresh() {
+	ctx, cancel := context.WithTimeout(context.Background(), d.interval)
+	defer cancel()
+
+	_, records, err := d.resolver.LookupSRV(ctx, "", "", d.name)
+	if err != nil {
+		log.Errorf("Error resolving SRV record %s: %v", d.name, err)
+		d.lookupFailuresMetric.Inc()
+		return
+	}
+
+	targets := make([]target, len(records))
+	for i, record := range records {
+		host := strings.TrimSuffix(record.Target, ".")
+		targets[i] = target{address: net.JoinHostPort(host, strconv.Itoa(int(record.Port)))}
+	}
+	d.update(targets)
+}
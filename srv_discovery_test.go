@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+type stubResolver struct {
+	records []*net.SRV
+	err     error
+}
+
+func (r *stubResolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	return "", r.records, r.err
+}
+
+func TestSRVDiscovery(t *testing.T) {
+	resolver := &stubResolver{
+		records: []*net.SRV{
+			{Target: "beanstalkd-1.queue.internal.", Port: 11300},
+			{Target: "beanstalkd-2.queue.internal.", Port: 11301},
+		},
+	}
+	var addresses []string
+	d := newSRVDiscovery("_beanstalk._tcp.queue.internal", time.Second, resolver, func(targets []target) {
+		addresses = nil
+		for _, t := range targets {
+			addresses = append(addresses, t.address)
+		}
+	})
+
+	d.refresh()
+	expected := []string{"beanstalkd-1.queue.internal:11300", "beanstalkd-2.queue.internal:11301"}
+	if !reflect.DeepEqual(addresses, expected) {
+		t.Fatalf("Expected %v, got %v", expected, addresses)
+	}
+
+	// A failed lookup keeps the previous servers.
+	resolver.err = errors.New("no such host")
+	d.refresh()
+	if !reflect.DeepEqual(addresses, expected) {
+		t.Fatalf("Expected %v to be kept, got %v", expected, addresses)
+	}
+	m := &dto.Metric{}
+	d.lookupFailuresMetric.Write(m)
+	if m.GetCounter().GetValue() != 1 {
+		t.Fatalf("Expected 1 lookup failure, got %v", m.GetCounter().GetValue())
+	}
+}
+
+func TestExporterSetTargets(t *testing.T) {
+	e := NewExporter("beanstalkd-static:11300")
+	e.SetTargets(srvSource, []target{{address: "beanstalkd-1:11300"}, {address: "beanstalkd-static:11300"}})
+	e.SetTargets(srvSource, []target{{address: "beanstalkd-2:11300"}})
+
+	var got []string
+	for _, s := range e.servers {
+		got = append(got, s.address)
+	}
+	expected := []string{"beanstalkd-2:11300", "beanstalkd-static:11300"}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("Expected servers %v, got %v", expected, got)
+	}
+}
@@ -1,5 +1,7 @@
 package main
 
+import "github.com/prometheus/client_golang/prometheus"
+
 var (
 	systemStatsHelp = map[string]string{
 		"current-jobs-urgent":     "is the number of ready jobs with priority < 1024.",
@@ -46,8 +48,8 @@ var (
 		"binlog-max-size":         "is the maximum size in bytes a binlog file is allowed to get before a new binlog file is opened.",
 		"binlog-records-written":  "is the cumulative number of records written to the binlog.",
 		"binlog-records-migrated": "is the cumulative number of records written as part of compaction.",
-		"id":       "is a random id string for this server process, generated when each beanstalkd process starts.",
-		"hostname": "is the hostname of the machine as determined by uname.",
+		"id":                      "is a random id string for this server process, generated when each beanstalkd process starts.",
+		"hostname":                "is the hostname of the machine as determined by uname.",
 	}
 
 	tubeStatsHelp = map[string]string{
@@ -66,4 +68,53 @@ var (
 		"cmd-pause-tube":        "is the cumulative number of pause-tube commands for this tube.",
 		"pause-time-left":       "is the number of seconds until the tube is un-paused.",
 	}
+
+	// systemStatsTypes lists the cumulative stats, exported as counters when
+	// enabled. All the other stats are gauges.
+	systemStatsTypes = map[string]prometheus.ValueType{
+		"cmd-put":                  prometheus.CounterValue,
+		"cmd-peek":                 prometheus.CounterValue,
+		"cmd-peek-ready":           prometheus.CounterValue,
+		"cmd-peek-delayed":         prometheus.CounterValue,
+		"cmd-peek-buried":          prometheus.CounterValue,
+		"cmd-reserve":              prometheus.CounterValue,
+		"cmd-reserve-with-timeout": prometheus.CounterValue,
+		"cmd-touch":                prometheus.CounterValue,
+		"cmd-use":                  prometheus.CounterValue,
+		"cmd-watch":                prometheus.CounterValue,
+		"cmd-ignore":               prometheus.CounterValue,
+		"cmd-delete":               prometheus.CounterValue,
+		"cmd-release":              prometheus.CounterValue,
+		"cmd-bury":                 prometheus.CounterValue,
+		"cmd-kick":                 prometheus.CounterValue,
+		"cmd-stats":                prometheus.CounterValue,
+		"cmd-stats-job":            prometheus.CounterValue,
+		"cmd-stats-tube":           prometheus.CounterValue,
+		"cmd-list-tubes":           prometheus.CounterValue,
+		"cmd-list-tube-used":       prometheus.CounterValue,
+		"cmd-list-tubes-watched":   prometheus.CounterValue,
+		"cmd-pause-tube":           prometheus.CounterValue,
+		"job-timeouts":             prometheus.CounterValue,
+		"total-jobs":               prometheus.CounterValue,
+		"total-connections":        prometheus.CounterValue,
+		"rusage-utime":             prometheus.CounterValue,
+		"rusage-stime":             prometheus.CounterValue,
+		"binlog-records-written":   prometheus.CounterValue,
+		"binlog-records-migrated":  prometheus.CounterValue,
+	}
+
+	// tubeStatsTypes lists the cumulative tube stats, exported as counters when
+	// enabled. All the other stats are gauges.
+	tubeStatsTypes = map[string]prometheus.ValueType{
+		"total-jobs":     prometheus.CounterValue,
+		"cmd-delete":     prometheus.CounterValue,
+		"cmd-pause-tube": prometheus.CounterValue,
+	}
+
+	// tubeStatsMax lists the tube stats aggregated with the maximum when
+	// several tubes are exported as one. All the other stats are summed.
+	tubeStatsMax = map[string]bool{
+		"pause":           true,
+		"pause-time-left": true,
+	}
 )
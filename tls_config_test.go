@@ -0,0 +1,112 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeSelfSignedCert writes a self-signed certificate for 127.0.0.1 and its
+// key in dir.
+func writeSelfSignedCert(t *testing.T, dir string, notAfter time.Time) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "beanstalkd"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              notAfter,
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "key.pem")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	if err := ioutil.WriteFile(certFile, certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestExporterTLS(t *testing.T) {
+	mapper = newTubeMapper()
+
+	dir, err := ioutil.TempDir("", "beanstalkd_exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	notAfter := time.Now().Add(24 * time.Hour).Truncate(time.Second)
+	certFile, keyFile := writeSelfSignedCert(t, dir, notAfter)
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := startFakeBeanstalkd(listener,
+		map[string]string{"current-jobs-ready": "4"},
+		map[string]map[string]string{"default": {"current-jobs-ready": "4"}},
+	)
+	defer server.close()
+
+	config, err := newTLSConfig(certFile, "", "", "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := NewExporter(server.addr())
+	e.SetTLSConfig(config, true)
+	families := gather(t, e)
+
+	labels := map[string]string{"instance": server.addr()}
+	if findMetric(families["beanstalkd_current_jobs_ready"], labels) == nil {
+		t.Fatalf("missing current_jobs_ready for %s", server.addr())
+	}
+	m := findMetric(families["beanstalkd_tls_peer_certificate_expiry_seconds"], labels)
+	if m == nil {
+		t.Fatalf("missing beanstalkd_tls_peer_certificate_expiry_seconds for %s", server.addr())
+	}
+	if got := m.GetGauge().GetValue(); got != float64(notAfter.Unix()) {
+		t.Fatalf("Expected certificate expiry %d, got %v", notAfter.Unix(), got)
+	}
+
+	// An untrusted certificate fails the handshake.
+	e = NewExporter(server.addr())
+	e.SetTLSConfig(&tls.Config{}, true)
+	families = gather(t, e)
+	if findMetric(families["beanstalkd_current_jobs_ready"], labels) != nil {
+		t.Fatalf("unexpected current_jobs_ready with an untrusted certificate")
+	}
+}
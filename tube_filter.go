@@ -0,0 +1,42 @@
+package main
+
+import (
+	"regexp"
+)
+
+// tubeFilter selects the tubes whose stats are fetched. A tube is kept when it
+// matches the include pattern, if any, and doesn't match the exclude pattern.
+type tubeFilter struct {
+	include *regexp.Regexp
+	exclude *regexp.Regexp
+}
+
+// newTubeFilter compiles the include and exclude patterns, which are anchored
+// to match the whole tube name. Empty patterns are ignored.
+func newTubeFilter(include, exclude string) (*tubeFilter, error) {
+	f := &tubeFilter{}
+	var err error
+	if include != "" {
+		if f.include, err = regexp.Compile("^(?:" + include + ")$"); err != nil {
+			return nil, err
+		}
+	}
+	if exclude != "" {
+		if f.exclude, err = regexp.Compile("^(?:" + exclude + ")$"); err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// keep reports whether the stats of the tube should be fetched. A nil filter
+// keeps every tube.
+func (f *tubeFilter) keep(tube string) bool {
+	if f == nil {
+		return true
+	}
+	if f.include != nil && !f.include.MatchString(tube) {
+		return false
+	}
+	return f.exclude == nil || !f.exclude.MatchString(tube)
+}
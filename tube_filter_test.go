@@ -0,0 +1,58 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestTubeFilter(t *testing.T) {
+	scenarios := []struct {
+		include string
+		exclude string
+		kept    []string
+		dropped []string
+	}{
+		{
+			kept: []string{"default", "user-42"},
+		},
+		{
+			include: "mail|user-.*",
+			kept:    []string{"mail", "user-42"},
+			dropped: []string{"default", "mailer", "old-user-42"},
+		},
+		{
+			exclude: "user-[0-9]+",
+			kept:    []string{"default", "user-x"},
+			dropped: []string{"user-42"},
+		},
+		{
+			include: "user-.*",
+			exclude: "user-test-.*",
+			kept:    []string{"user-42"},
+			dropped: []string{"user-test-1", "default"},
+		},
+	}
+
+	for i, scenario := range scenarios {
+		f, err := newTubeFilter(scenario.include, scenario.exclude)
+		if err != nil {
+			t.Fatalf("%d. unexpected error: %s", i, err)
+		}
+		for _, tube := range scenario.kept {
+			if !f.keep(tube) {
+				t.Fatalf("%d. Expected %s to be kept", i, tube)
+			}
+		}
+		for _, tube := range scenario.dropped {
+			if f.keep(tube) {
+				t.Fatalf("%d. Expected %s to be filtered out", i, tube)
+			}
+		}
+	}
+
+	if _, err := newTubeFilter("(", ""); err == nil {
+		t.Fatalf("Expected an error for an invalid pattern")
+	}
+	if !(*tubeFilter)(nil).keep("default") {
+		t.Fatalf("Expected a nil filter to keep every tube")
+	}
+}
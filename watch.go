@@ -0,0 +1,145 @@
+package main
+
+import (
+	"crypto/sha256"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/howeyc/fsnotify"
+	"github.com/prometheus/common/log"
+)
+
+// watchDebounce is the time to wait for a burst of file events to end before
+// checking whether a watched config changed.
+const watchDebounce = time.Second
+
+// watchFile calls onChange every time the content of the file, or of the
+// files in the directory, changes. It never returns.
+//
+// The parent directory of a file is watched rather than the file itself, so
+// that the watch survives the file being replaced, e.g. by an editor or when
+// Kubernetes swaps the symlinks of a ConfigMap. The events are debounced and
+// onChange is only called when the content hash differs from the last one.
+func watchFile(fileName string, debounce time.Duration, onChange func()) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	dir := fileName
+	if info, err := os.Stat(fileName); err != nil || !info.IsDir() {
+		dir = filepath.Dir(fileName)
+	}
+	if err := watcher.Watch(dir); err != nil {
+		log.Fatal(err)
+	}
+
+	lastHash, err := hashConfigFiles(fileName)
+	if err != nil {
+		log.Errorf("Error reading %s: %v", fileName, err)
+	}
+
+	var settled <-chan time.Time
+	for {
+		select {
+		case ev := <-watcher.Event:
+			log.Debugf("File event (%s)", ev)
+			settled = time.After(debounce)
+		case <-settled:
+			settled = nil
+			hash, err := hashConfigFiles(fileName)
+			if err != nil {
+				log.Errorf("Error reading %s: %v", fileName, err)
+				continue
+			}
+			if hash == lastHash {
+				log.Debugf("%s didn't change", fileName)
+				continue
+			}
+			lastHash = hash
+			log.Warnf("%s changed, attempting reload", fileName)
+			onChange()
+		case err := <-watcher.Error:
+			log.Errorf("Error watching %s: %v", fileName, err)
+		}
+	}
+}
+
+// configFiles returns the files of a config: the file itself, or the regular
+// files of a directory in lexical order. Hidden files are ignored, along with
+// the ..data directories and symlinks of Kubernetes ConfigMaps.
+func configFiles(fileName string) ([]string, error) {
+	info, err := os.Stat(fileName)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []string{fileName}, nil
+	}
+
+	entries, err := ioutil.ReadDir(fileName)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		path := filepath.Join(fileName, entry.Name())
+		// follow symlinks
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if info.Mode().IsRegular() {
+			files = append(files, path)
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// configFile is a file of a config, along with its contents.
+type configFile struct {
+	path     string
+	contents []byte
+}
+
+// readConfigFiles reads the files of a config and returns them along with a
+// hash of their names and contents, so that the hash is the one of the config
+// that is parsed.
+func readConfigFiles(fileName string) ([]configFile, [sha256.Size]byte, error) {
+	var hash [sha256.Size]byte
+	paths, err := configFiles(fileName)
+	if err != nil {
+		return nil, hash, err
+	}
+
+	files := make([]configFile, 0, len(paths))
+	h := sha256.New()
+	for _, path := range paths {
+		contents, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, hash, err
+		}
+		h.Write([]byte(filepath.Base(path)))
+		h.Write([]byte{0})
+		h.Write(contents)
+		h.Write([]byte{0})
+		files = append(files, configFile{path: path, contents: contents})
+	}
+	copy(hash[:], h.Sum(nil))
+	return files, hash, nil
+}
+
+// hashConfigFiles returns a hash of the names and contents of the files of a
+// config.
+func hashConfigFiles(fileName string) ([sha256.Size]byte, error) {
+	_, hash, err := readConfigFiles(fileName)
+	return hash, err
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestConfigFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "beanstalkd_exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the layout of a Kubernetes ConfigMap
+	data := filepath.Join(dir, "..2019_01_01")
+	if err := os.Mkdir(data, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"20-b.conf", "10-a.yml"} {
+		if err := ioutil.WriteFile(filepath.Join(data, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(data, filepath.Join(dir, "..data")); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"20-b.conf", "10-a.yml"} {
+		if err := os.Symlink(filepath.Join("..data", name), filepath.Join(dir, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(dir, "subdir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := configFiles(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{filepath.Join(dir, "10-a.yml"), filepath.Join(dir, "20-b.conf")}
+	if !reflect.DeepEqual(files, expected) {
+		t.Fatalf("Expected %v, got %v", expected, files)
+	}
+
+	fileName := filepath.Join(dir, "10-a.yml")
+	files, err = configFiles(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(files, []string{fileName}) {
+		t.Fatalf("Expected %v, got %v", []string{fileName}, files)
+	}
+}
+
+func TestWatchFile(t *testing.T) {
+	debounce := 100 * time.Millisecond
+
+	dir, err := ioutil.TempDir("", "beanstalkd_exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fileName := filepath.Join(dir, "mapping.conf")
+
+	write := func(contents string) {
+		// replace the file like editors and Kubernetes do
+		tmp := filepath.Join(dir, ".mapping.conf.tmp")
+		if err := ioutil.WriteFile(tmp, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename(tmp, fileName); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("a")
+
+	changes := make(chan struct{}, 10)
+	go watchFile(fileName, debounce, func() { changes <- struct{}{} })
+	time.Sleep(100 * time.Millisecond)
+
+	scenarios := []struct {
+		writes  []string
+		changes int
+	}{
+		// a burst of events
+		{writes: []string{"b", "c", "d"}, changes: 1},
+		// same content
+		{writes: []string{"d"}, changes: 0},
+		// changed back and forth
+		{writes: []string{"e", "d"}, changes: 0},
+		{writes: []string{"e"}, changes: 1},
+		// the file is replaced a second time
+		{writes: []string{"f"}, changes: 1},
+	}
+
+	for i, scenario := range scenarios {
+		for _, contents := range scenario.writes {
+			write(contents)
+		}
+		time.Sleep(5 * debounce)
+
+		got := len(changes)
+		for j := 0; j < got; j++ {
+			<-changes
+		}
+		if got != scenario.changes {
+			t.Fatalf("%d. Expected %d changes, got %d", i, scenario.changes, got)
+		}
+	}
+}